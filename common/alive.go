@@ -0,0 +1,98 @@
+package common
+
+import "slices"
+
+type AliveFilter string
+
+const (
+	AliveFilterAll   AliveFilter = ""      // keep all voice segments
+	AliveFilterAlive AliveFilter = "alive" // keep segments sent while the speaker was alive
+	AliveFilterDead  AliveFilter = "dead"  // keep segments sent while the speaker was dead ("dead chat")
+)
+
+var AliveFilters = []AliveFilter{AliveFilterAlive, AliveFilterDead}
+
+func (filter AliveFilter) IsValid() bool {
+	return filter == AliveFilterAll || slices.Contains(AliveFilters, filter)
+}
+
+func (filter AliveFilter) keep(segment VoiceSegment) bool {
+	switch filter {
+	case AliveFilterAlive:
+		return segment.IsAlive
+	case AliveFilterDead:
+		return !segment.IsAlive
+	default:
+		return true
+	}
+}
+
+// KeepSegment returns true when the segment matches options.AliveFilter and is heard by the POV player if set.
+func (options ExtractOptions) KeepSegment(segment VoiceSegment) bool {
+	isHeard := options.POVSteamID == 0 || segment.Spatial != nil
+
+	return isHeard && options.AliveFilter.keep(segment)
+}
+
+// FilterSegments returns the segments that match options.AliveFilter, that are heard by the POV player if set, and the
+// players that still have segments.
+func (options ExtractOptions) FilterSegments(segmentsPerPlayer map[string][]VoiceSegment, players map[string]Player) (map[string][]VoiceSegment, map[string]Player) {
+	if options.AliveFilter == AliveFilterAll && options.POVSteamID == 0 {
+		return segmentsPerPlayer, players
+	}
+
+	filteredSegments := make(map[string][]VoiceSegment)
+	filteredPlayers := make(map[string]Player)
+	for playerID, segments := range segmentsPerPlayer {
+		for _, segment := range segments {
+			if options.KeepSegment(segment) {
+				filteredSegments[playerID] = append(filteredSegments[playerID], segment)
+			}
+		}
+
+		if len(filteredSegments[playerID]) > 0 {
+			filteredPlayers[playerID] = players[playerID]
+		}
+	}
+
+	return filteredSegments, filteredPlayers
+}
+
+// GetPlayerFileID returns the ID used to name the per-player file in which the segment is written.
+func (options ExtractOptions) GetPlayerFileID(playerID string, segment VoiceSegment) string {
+	if !options.SplitAliveDead {
+		return playerID
+	}
+
+	state := string(AliveFilterDead)
+	if segment.IsAlive {
+		state = string(AliveFilterAlive)
+	}
+
+	return playerID + "_" + state
+}
+
+// GetPlayerFilesSegments returns the segments to write in per-player files. When options.SplitAliveDead is true,
+// each player has 2 entries with the IDs <playerID>_alive and <playerID>_dead so that the files are named
+// <demoName>_<playerID>_alive and <demoName>_<playerID>_dead.
+func (options ExtractOptions) GetPlayerFilesSegments(segmentsPerPlayer map[string][]VoiceSegment, players map[string]Player) (map[string][]VoiceSegment, map[string]Player) {
+	if !options.SplitAliveDead {
+		return segmentsPerPlayer, players
+	}
+
+	splitSegments := make(map[string][]VoiceSegment)
+	splitPlayers := make(map[string]Player)
+	for playerID, segments := range segmentsPerPlayer {
+		for _, segment := range segments {
+			splitID := options.GetPlayerFileID(playerID, segment)
+			if _, ok := splitPlayers[splitID]; !ok {
+				player := players[playerID]
+				player.ID = splitID
+				splitPlayers[splitID] = player
+			}
+			splitSegments[splitID] = append(splitSegments[splitID], segment)
+		}
+	}
+
+	return splitSegments, splitPlayers
+}
@@ -1,16 +1,21 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 )
 
 var ShouldExitOnFirstError = false
 var LibrariesPath string
 
+// demos may be processed concurrently
+var librariesPathMutex sync.Mutex
+
 type ExitCode int
 
 type Error struct {
@@ -39,8 +44,6 @@ type UnsupportedCodec struct {
 	Version int32
 }
 
-var UnsupportedCodecError *UnsupportedCodec
-
 func (err *Error) Error() string {
 	if err.Err != nil {
 		return fmt.Sprintf("%s\n%s", err.Message, err.Err.Error())
@@ -49,42 +52,66 @@ func (err *Error) Error() string {
 	return fmt.Sprintf("%s\n", err.Message)
 }
 
-func NewError(message string, err error, exitCode ExitCode) Error {
-	return Error{
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+func NewError(message string, err error, exitCode ExitCode) *Error {
+	return &Error{
 		Message:  message,
 		Err:      err,
 		ExitCode: exitCode,
 	}
 }
 
-func NewDecodingError(message string, err error) Error {
+func NewDecodingError(message string, err error) *Error {
 	return NewError(message, err, DecodingError)
 }
 
-func NewWavFileCreationError(message string, err error) Error {
+func NewWavFileCreationError(message string, err error) *Error {
 	return NewError(message, err, WavFileCreationError)
 }
 
-func HandleError(err Error) Error {
+func NewInvalidArgumentError(message string, err error) *Error {
+	return NewError(message, err, InvalidArguments)
+}
+
+func NewUnsupportedCodecError(codec *UnsupportedCodec) *Error {
+	return NewError(
+		fmt.Sprintf("unsupported audio codec: %s %d %d", codec.Name, codec.Quality, codec.Version),
+		nil,
+		UnsupportedAudioCodec,
+	)
+}
+
+// GetExitCode returns the exit code associated with the error, ParsingError is used for errors not created by this
+// package.
+func GetExitCode(err error) ExitCode {
+	var extractError *Error
+	if errors.As(err, &extractError) {
+		return extractError.ExitCode
+	}
+
+	return ParsingError
+}
+
+func HandleError(err error) error {
 	fmt.Fprint(os.Stderr, err.Error())
 	if ShouldExitOnFirstError {
-		os.Exit(int(err.ExitCode))
+		os.Exit(int(GetExitCode(err)))
 	}
 
 	return err
 }
 
-func HandleInvalidArgument(message string, err error) Error {
+func HandleInvalidArgument(message string, err error) error {
 	ShouldExitOnFirstError = true
 
-	return HandleError(Error{
-		Message:  message,
-		Err:      err,
-		ExitCode: InvalidArguments,
-	})
+	return HandleError(NewInvalidArgumentError(message, err))
 }
 
-func AssertLibraryFilesExist() {
+// CheckLibraryFiles resolves LibrariesPath and makes sure that the audio libraries exist in it.
+func CheckLibraryFiles() error {
 	var ldLibraryPath string
 	if runtime.GOOS == "darwin" {
 		ldLibraryPath = os.Getenv("DYLD_LIBRARY_PATH")
@@ -95,23 +122,22 @@ func AssertLibraryFilesExist() {
 	// The env variable LD_LIBRARY_PATH is mandatory only on unix platforms, see decoder.c for details.
 	if ldLibraryPath == "" && runtime.GOOS != "windows" {
 		if runtime.GOOS == "darwin" {
-			HandleInvalidArgument("DYLD_LIBRARY_PATH is missing, usage example: DYLD_LIBRARY_PATH=. csgove myDemo.dem", nil)
-		} else {
-			HandleInvalidArgument("LD_LIBRARY_PATH is missing, usage example: LD_LIBRARY_PATH=. csgove myDemo.dem", nil)
+			return NewInvalidArgumentError("DYLD_LIBRARY_PATH is missing, usage example: DYLD_LIBRARY_PATH=. csgove myDemo.dem", nil)
 		}
+
+		return NewInvalidArgumentError("LD_LIBRARY_PATH is missing, usage example: LD_LIBRARY_PATH=. csgove myDemo.dem", nil)
 	}
 
-	var err error
-	LibrariesPath, err = filepath.Abs(ldLibraryPath)
+	librariesPath, err := filepath.Abs(ldLibraryPath)
 	if err != nil {
-		HandleInvalidArgument("Invalid library path provided", err)
+		return NewInvalidArgumentError("Invalid library path provided", err)
 	}
 
-	LibrariesPath = strings.TrimSuffix(LibrariesPath, string(os.PathSeparator))
+	librariesPath = strings.TrimSuffix(librariesPath, string(os.PathSeparator))
 
-	_, err = os.Stat(LibrariesPath)
+	_, err = os.Stat(librariesPath)
 	if os.IsNotExist(err) {
-		HandleInvalidArgument("Library folder doesn't exists", err)
+		return NewInvalidArgumentError("Library folder doesn't exists", err)
 	}
 
 	var requiredFiles []string
@@ -125,28 +151,31 @@ func AssertLibraryFilesExist() {
 	}
 
 	for _, requiredFile := range requiredFiles {
-		_, err = os.Stat(LibrariesPath + string(os.PathSeparator) + requiredFile)
+		_, err = os.Stat(librariesPath + string(os.PathSeparator) + requiredFile)
 		if os.IsNotExist(err) {
-			ShouldExitOnFirstError = true
-			HandleError(Error{
-				Message:  "The required library file " + requiredFile + " doesn't exists",
-				Err:      err,
-				ExitCode: MissingLibraryFiles,
-			})
+			return NewError("The required library file "+requiredFile+" doesn't exists", err, MissingLibraryFiles)
 		}
 	}
+
+	librariesPathMutex.Lock()
+	LibrariesPath = librariesPath
+	librariesPathMutex.Unlock()
+
+	return nil
 }
 
-func AssertCodecIsSupported() {
-	if UnsupportedCodecError != nil {
-		HandleError(Error{
-			Message: fmt.Sprintf(
-				"unsupported audio codec: %s %d %d",
-				UnsupportedCodecError.Name,
-				UnsupportedCodecError.Quality,
-				UnsupportedCodecError.Version,
-			),
-			ExitCode: UnsupportedAudioCodec,
-		})
+// GetLibrariesPath returns the path resolved by CheckLibraryFiles.
+func GetLibrariesPath() string {
+	librariesPathMutex.Lock()
+	defer librariesPathMutex.Unlock()
+
+	return LibrariesPath
+}
+
+func AssertLibraryFilesExist() {
+	err := CheckLibraryFiles()
+	if err != nil {
+		ShouldExitOnFirstError = true
+		HandleError(err)
 	}
 }
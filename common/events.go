@@ -0,0 +1,233 @@
+package common
+
+import (
+	"path/filepath"
+
+	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
+	demcommon "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/common"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/events"
+)
+
+// DefaultEventWindowSeconds is the default duration before the start and after the end of an utterance in which
+// events are considered nearby.
+const DefaultEventWindowSeconds = 5.0
+
+type GameEventType string
+
+const (
+	GameEventKill        GameEventType = "kill"
+	GameEventBombPlanted GameEventType = "bomb_planted"
+	GameEventBombDefused GameEventType = "bomb_defused"
+	GameEventRoundStart  GameEventType = "round_start"
+	GameEventRoundEnd    GameEventType = "round_end"
+)
+
+type GameEvent struct {
+	Type          GameEventType `json:"type"`
+	Time          float64       `json:"time"`                           // in seconds
+	DemoTime      float64       `json:"demoTime"`                       // in seconds from the start of the demo, differs from time with -start
+	Tick          int           `json:"tick"`                           // demo tick
+	Round         int           `json:"round"`                          // 0 if the event is not during a round
+	SteamID       uint64        `json:"steamId,string,omitempty"`       // killer, planter or defuser
+	Name          string        `json:"name,omitempty"`                 // killer, planter or defuser
+	VictimSteamID uint64        `json:"victimSteamId,string,omitempty"` // kill only
+	VictimName    string        `json:"victimName,omitempty"`           // kill only
+	Weapon        string        `json:"weapon,omitempty"`               // kill only
+	IsHeadshot    bool          `json:"isHeadshot,omitempty"`           // kill only
+	Site          string        `json:"site,omitempty"`                 // bomb events only
+	Winner        string        `json:"winner,omitempty"`               // round end only, CT or T
+}
+
+func getTeamName(team demcommon.Team) string {
+	switch team {
+	case demcommon.TeamCounterTerrorists:
+		return "CT"
+	case demcommon.TeamTerrorists:
+		return "T"
+	default:
+		return ""
+	}
+}
+
+// EventTracker collects the game events useful to understand voice lines while the demo is parsed, warmup events
+// are ignored.
+type EventTracker struct {
+	parser dem.Parser
+	clock  *Clock
+	events []GameEvent
+}
+
+func NewEventTracker(parser dem.Parser, clock *Clock) *EventTracker {
+	tracker := &EventTracker{
+		parser: parser,
+		clock:  clock,
+		events: make([]GameEvent, 0),
+	}
+
+	parser.RegisterEventHandler(tracker.onKill)
+	parser.RegisterEventHandler(tracker.onBombPlanted)
+	parser.RegisterEventHandler(tracker.onBombDefused)
+	parser.RegisterEventHandler(tracker.onRoundStart)
+	parser.RegisterEventHandler(tracker.onRoundEnd)
+
+	return tracker
+}
+
+func (tracker *EventTracker) add(event GameEvent, player *demcommon.Player) {
+	if tracker.parser.GameState().IsWarmupPeriod() {
+		return
+	}
+
+	event.Time = tracker.clock.Seconds()
+	event.DemoTime = event.Time
+	event.Tick = tracker.clock.DemoTick()
+	if player != nil {
+		event.SteamID = player.SteamID64
+		event.Name = player.Name
+	}
+	tracker.events = append(tracker.events, event)
+}
+
+func (tracker *EventTracker) onKill(kill events.Kill) {
+	event := GameEvent{
+		Type:       GameEventKill,
+		IsHeadshot: kill.IsHeadshot,
+	}
+	if kill.Victim != nil {
+		event.VictimSteamID = kill.Victim.SteamID64
+		event.VictimName = kill.Victim.Name
+	}
+	if kill.Weapon != nil {
+		event.Weapon = kill.Weapon.String()
+	}
+
+	tracker.add(event, kill.Killer)
+}
+
+func (tracker *EventTracker) onBombPlanted(bombPlanted events.BombPlanted) {
+	tracker.add(GameEvent{
+		Type: GameEventBombPlanted,
+		Site: string(rune(bombPlanted.Site)),
+	}, bombPlanted.Player)
+}
+
+func (tracker *EventTracker) onBombDefused(bombDefused events.BombDefused) {
+	tracker.add(GameEvent{
+		Type: GameEventBombDefused,
+		Site: string(rune(bombDefused.Site)),
+	}, bombDefused.Player)
+}
+
+func (tracker *EventTracker) onRoundStart(events.RoundStart) {
+	tracker.add(GameEvent{
+		Type: GameEventRoundStart,
+	}, nil)
+}
+
+func (tracker *EventTracker) onRoundEnd(roundEnd events.RoundEnd) {
+	tracker.add(GameEvent{
+		Type:   GameEventRoundEnd,
+		Winner: getTeamName(roundEnd.Winner),
+	}, nil)
+}
+
+// Events returns the collected events with their round number.
+func (tracker *EventTracker) Events(rounds []Round) []GameEvent {
+	for index := range tracker.events {
+		tracker.events[index].Round = GetRoundNumber(rounds, tracker.events[index].Time)
+	}
+
+	return tracker.events
+}
+
+type AnnotatedUtterance struct {
+	SteamID       uint64      `json:"steamId,string"`
+	Name          string      `json:"name"`
+	StartTime     float64     `json:"startTime"`     // in seconds
+	EndTime       float64     `json:"endTime"`       // in seconds
+	DemoStartTime float64     `json:"demoStartTime"` // in seconds from the start of the demo
+	DemoEndTime   float64     `json:"demoEndTime"`   // in seconds from the start of the demo
+	StartTick     int         `json:"startTick"`
+	Round         int         `json:"round"` // 0 if the utterance is not during a round
+	IsAlive       bool        `json:"isAlive"`
+	Events        []GameEvent `json:"events"` // events that happened from WindowSeconds before the start to WindowSeconds after the end
+}
+
+type EventTimeline struct {
+	Demo          string               `json:"demo"`
+	Window        *TimeWindow          `json:"window,omitempty"` // extracted part of the demo with -start or -end
+	WindowSeconds float64              `json:"windowSeconds"`
+	Events        []GameEvent          `json:"events"`
+	Utterances    []AnnotatedUtterance `json:"utterances"`
+}
+
+// BuildEventTimeline returns the game events and the utterances with their nearby events, both sorted by time.
+func BuildEventTimeline(result *Result, segmentsPerPlayer map[string][]VoiceSegment, options ExtractOptions) EventTimeline {
+	windowSeconds := options.EventWindowSeconds
+	if windowSeconds <= 0 {
+		windowSeconds = DefaultEventWindowSeconds
+	}
+
+	timeline := EventTimeline{
+		Demo:          options.DemoName,
+		Window:        result.Window,
+		WindowSeconds: windowSeconds,
+		Events:        result.Events,
+		Utterances:    make([]AnnotatedUtterance, 0),
+	}
+	if timeline.Events == nil {
+		timeline.Events = make([]GameEvent, 0)
+	}
+
+	players := make(map[string]Player, len(result.Players))
+	for _, player := range result.Players {
+		players[player.ID] = player
+	}
+
+	// events are sorted by time, the first event that may be nearby the next utterance only moves forward because
+	// utterances are sorted by start time too
+	firstEventIndex := 0
+	for _, utterance := range options.GetUtterances(segmentsPerPlayer) {
+		endTime := options.Placements.GetUtteranceEndTime(utterance)
+		windowStart := utterance.StartTime - windowSeconds
+		windowEnd := endTime + windowSeconds
+		for firstEventIndex < len(timeline.Events) && timeline.Events[firstEventIndex].Time < windowStart {
+			firstEventIndex++
+		}
+
+		nearbyEvents := make([]GameEvent, 0)
+		for _, event := range timeline.Events[firstEventIndex:] {
+			if event.Time > windowEnd {
+				break
+			}
+			nearbyEvents = append(nearbyEvents, event)
+		}
+
+		player := players[utterance.PlayerID]
+		timeline.Utterances = append(timeline.Utterances, AnnotatedUtterance{
+			SteamID:       player.SteamID,
+			Name:          player.Name,
+			StartTime:     utterance.StartTime,
+			EndTime:       endTime,
+			DemoStartTime: result.GetDemoTime(utterance.StartTime),
+			DemoEndTime:   result.GetDemoTime(endTime),
+			StartTick:     utterance.StartTick,
+			Round:         GetRoundNumber(result.Rounds, utterance.StartTime),
+			IsAlive:       utterance.IsAlive,
+			Events:        nearbyEvents,
+		})
+	}
+
+	return timeline
+}
+
+// WriteEventTimeline writes <demoName>.events.json in the output folder and returns its path.
+func WriteEventTimeline(result *Result, segmentsPerPlayer map[string][]VoiceSegment, options ExtractOptions) (string, error) {
+	path := filepath.Join(options.OutputPath, options.DemoName+".events.json")
+	err := WriteJSONFile(path, BuildEventTimeline(result, segmentsPerPlayer, options))
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
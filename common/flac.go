@@ -0,0 +1,172 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+const (
+	flacBlockSize   = 4096
+	flacMaxBitDepth = 24 // the FLAC encoder doesn't support 32-bit samples
+	flacMaxChannels = 8
+)
+
+type FlacSink struct {
+	encoder         *flac.Encoder
+	format          AudioFormat
+	bitDepth        int
+	shift           int   // number of low bits dropped when the source bit depth exceeds flacMaxBitDepth
+	buffer          []int // interleaved samples not encoded yet
+	writtenPosition int
+}
+
+// NewFlacSink encodes PCM frames as a FLAC stream. Samples with a bit depth above 24 bits are written with 24 bits.
+// The stream info block is updated on Close only if the writer implements io.WriteSeeker.
+func NewFlacSink(writer io.Writer, format AudioFormat) (*FlacSink, error) {
+	if format.NumChannels < 1 || format.NumChannels > flacMaxChannels {
+		return nil, NewWavFileCreationError(fmt.Sprintf("FLAC supports up to %d channels, got %d", flacMaxChannels, format.NumChannels), nil)
+	}
+
+	bitDepth := min(format.BitDepth, flacMaxBitDepth)
+	info := &meta.StreamInfo{
+		BlockSizeMin:  flacBlockSize,
+		BlockSizeMax:  flacBlockSize,
+		SampleRate:    uint32(format.SampleRate),
+		NChannels:     uint8(format.NumChannels),
+		BitsPerSample: uint8(bitDepth),
+	}
+
+	encoder, err := flac.NewEncoder(writer, info)
+	if err != nil {
+		return nil, NewWavFileCreationError("Couldn't write FLAC file", err)
+	}
+
+	return &FlacSink{
+		encoder:  encoder,
+		format:   format,
+		bitDepth: bitDepth,
+		shift:    format.BitDepth - bitDepth,
+		buffer:   make([]int, 0, flacBlockSize*format.NumChannels),
+	}, nil
+}
+
+func (sink *FlacSink) Write(frame AudioFrame) error {
+	// fill the gap with silence
+	if frame.Position > sink.writtenPosition {
+		err := WriteSilence(sink, sink.format, sink.writtenPosition, frame.Position)
+		if err != nil {
+			return err
+		}
+	}
+
+	data := frame.Data
+	for len(data) > 0 {
+		length := min(len(data), cap(sink.buffer)-len(sink.buffer))
+		sink.buffer = append(sink.buffer, data[:length]...)
+		data = data[length:]
+		if len(sink.buffer) == cap(sink.buffer) {
+			err := sink.flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	sink.writtenPosition += len(frame.Data) / sink.format.NumChannels
+
+	return nil
+}
+
+func (sink *FlacSink) flush() error {
+	numChannels := sink.format.NumChannels
+	blockSize := len(sink.buffer) / numChannels
+	if blockSize == 0 {
+		return nil
+	}
+
+	subframes := make([]*frame.Subframe, numChannels)
+	for channel := range subframes {
+		samples := make([]int32, blockSize)
+		for i := range samples {
+			samples[i] = int32(sink.buffer[i*numChannels+channel] >> sink.shift)
+		}
+
+		subframes[channel] = &frame.Subframe{
+			SubHeader: frame.SubHeader{Pred: frame.PredVerbatim},
+			Samples:   samples,
+			NSamples:  blockSize,
+		}
+	}
+
+	err := sink.encoder.WriteFrame(&frame.Frame{
+		Header: frame.Header{
+			HasFixedBlockSize: true,
+			BlockSize:         uint16(blockSize),
+			SampleRate:        uint32(sink.format.SampleRate),
+			Channels:          frame.Channels(numChannels - 1), // mono is 0, then 1 constant per channel count
+			BitsPerSample:     uint8(sink.bitDepth),
+		},
+		Subframes: subframes,
+	})
+	if err != nil {
+		return NewWavFileCreationError("Couldn't write FLAC file", err)
+	}
+
+	sink.buffer = sink.buffer[:0]
+
+	return nil
+}
+
+// Close encodes the remaining samples and closes the writer if it implements io.Closer.
+func (sink *FlacSink) Close() error {
+	err := sink.flush()
+	closeErr := sink.encoder.Close()
+	if err != nil {
+		return err
+	}
+
+	if closeErr != nil {
+		return NewWavFileCreationError("Couldn't write FLAC file", closeErr)
+	}
+
+	return nil
+}
+
+type FlacFileSink struct {
+	*FlacSink
+	path string
+}
+
+func NewFlacFileSink(path string, format AudioFormat) (*FlacFileSink, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, NewWavFileCreationError("Couldn't create FLAC file", err)
+	}
+
+	sink, err := NewFlacSink(file, format)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &FlacFileSink{
+		FlacSink: sink,
+		path:     path,
+	}, nil
+}
+
+func (sink *FlacFileSink) Path() string {
+	return sink.path
+}
+
+func NewFlacFileSinkFactory(outputPath string) AudioSinkFactory {
+	return func(info AudioSinkInfo) (AudioSink, error) {
+		return NewFlacFileSink(filepath.Join(outputPath, info.Name+".flac"), info.Format)
+	}
+}
@@ -1,16 +1,30 @@
 package common
 
-import "os"
+import (
+	"encoding/json"
+	"os"
+)
 
 func CreateWavFile(wavFilePath string) (*os.File, error) {
 	file, err := os.Create(wavFilePath)
 	if err != nil {
-		HandleError(Error{
-			Message:  "Couldn't create WAV file",
-			Err:      err,
-			ExitCode: WavFileCreationError,
-		})
+		return nil, NewWavFileCreationError("Couldn't create WAV file", err)
 	}
 
-	return file, err
+	return file, nil
+}
+
+// WriteJSONFile writes the value as indented JSON, used for sidecar files.
+func WriteJSONFile(path string, value any) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return NewWavFileCreationError("Couldn't encode JSON file", err)
+	}
+
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		return NewWavFileCreationError("Couldn't write JSON file", err)
+	}
+
+	return nil
 }
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"slices"
+)
+
+type PacketLossConcealment string
+
+const (
+	ConcealmentOff PacketLossConcealment = "off" // lost packets are skipped
+	ConcealmentPLC PacketLossConcealment = "plc" // lost packets are predicted by the decoder
+	ConcealmentFEC PacketLossConcealment = "fec" // the last lost packet is recovered from the next one, PLC for the others
+)
+
+var PacketLossConcealments = []PacketLossConcealment{ConcealmentOff, ConcealmentPLC, ConcealmentFEC}
+
+func (concealment PacketLossConcealment) IsValid() bool {
+	return concealment == "" || slices.Contains(PacketLossConcealments, concealment)
+}
+
+// IsEnabled returns true when lost packets are concealed.
+func (concealment PacketLossConcealment) IsEnabled() bool {
+	return concealment == ConcealmentPLC || concealment == ConcealmentFEC
+}
+
+// GetLossRate returns the ratio of voice packets lost among the packets sent by the player.
+func (player Player) GetLossRate() float64 {
+	sentPackets := player.SegmentCount + player.LostPackets
+	if sentPackets == 0 {
+		return 0
+	}
+
+	return float64(player.LostPackets) / float64(sentPackets)
+}
+
+// LogPacketLoss writes the number of voice packets lost and received late per player, nothing is written for players
+// without loss.
+func LogPacketLoss(players []Player, options ExtractOptions) {
+	for _, player := range players {
+		if player.LostPackets == 0 && player.LatePackets == 0 {
+			continue
+		}
+
+		options.Logf("%s: %d voice packets lost (%.1f%%), %d received late or twice\n", player.Name, player.LostPackets, player.GetLossRate()*100, player.LatePackets)
+	}
+}
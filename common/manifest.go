@@ -0,0 +1,211 @@
+package common
+
+import "path/filepath"
+
+// SegmentPlacement describes where a voice segment has been written in an output.
+type SegmentPlacement struct {
+	File        string // file name, empty if the sink doesn't write a file
+	Position    int    // position of the first sample in the output, in samples per channel
+	SampleCount int
+	SampleRate  int
+}
+
+type segmentKey struct {
+	playerID string
+	index    int
+}
+
+// PlacementRecorder collects the placements of voice segments written by the generators to build the manifest.
+// Methods are no-op on a nil recorder.
+type PlacementRecorder struct {
+	placements map[segmentKey][]SegmentPlacement
+}
+
+func NewPlacementRecorder() *PlacementRecorder {
+	return &PlacementRecorder{
+		placements: make(map[segmentKey][]SegmentPlacement),
+	}
+}
+
+// Record stores that the segment has been written in the sink at the given position.
+func (recorder *PlacementRecorder) Record(segment VoiceSegment, sink AudioSink, position int, sampleCount int, sampleRate int) {
+	if recorder == nil {
+		return
+	}
+
+	file := GetSinkPath(sink)
+	if file != "" {
+		file = filepath.Base(file)
+	}
+
+	recorder.RecordFile(segment, file, position, sampleCount, sampleRate)
+}
+
+// RecordFile is the same as Record for outputs that are not written through a sink.
+func (recorder *PlacementRecorder) RecordFile(segment VoiceSegment, file string, position int, sampleCount int, sampleRate int) {
+	if recorder == nil {
+		return
+	}
+
+	key := segmentKey{segment.PlayerID, segment.Index}
+	recorder.placements[key] = append(recorder.placements[key], SegmentPlacement{
+		File:        file,
+		Position:    position,
+		SampleCount: sampleCount,
+		SampleRate:  sampleRate,
+	})
+}
+
+func (recorder *PlacementRecorder) get(segment VoiceSegment) []SegmentPlacement {
+	if recorder == nil {
+		return nil
+	}
+
+	return recorder.placements[segmentKey{segment.PlayerID, segment.Index}]
+}
+
+// GetUtteranceEndTime returns the time at which the last decoded sample of the utterance is played, or the timestamp
+// of its last segment if no placements have been recorded.
+func (recorder *PlacementRecorder) GetUtteranceEndTime(utterance Utterance) float64 {
+	endTime := utterance.EndTime
+	for _, segment := range utterance.Segments {
+		for _, placement := range recorder.get(segment) {
+			endTime = max(endTime, segment.Timestamp+float64(placement.SampleCount)/float64(placement.SampleRate))
+		}
+	}
+
+	return endTime
+}
+
+type ManifestSpeaker struct {
+	SteamID     uint64  `json:"steamId,string"`
+	Name        string  `json:"name"`
+	ID          string  `json:"id"`
+	LostPackets int     `json:"lostPackets"` // voice packets detected as lost, CS2 Opus only
+	LatePackets int     `json:"latePackets"` // voice packets received late or twice, dropped with concealment
+	LossRate    float64 `json:"lossRate"`    // ratio of voice packets lost among the packets sent
+}
+
+type ManifestOutput struct {
+	File         string `json:"file,omitempty"`
+	SampleOffset int    `json:"sampleOffset"`
+	SampleRate   int    `json:"sampleRate"`
+}
+
+type ManifestUtterance struct {
+	SteamID       uint64           `json:"steamId,string"`
+	StartTime     float64          `json:"startTime"`     // in seconds
+	EndTime       float64          `json:"endTime"`       // in seconds
+	DemoStartTime float64          `json:"demoStartTime"` // in seconds from the start of the demo
+	DemoEndTime   float64          `json:"demoEndTime"`   // in seconds from the start of the demo
+	StartTick     int              `json:"startTick"`     // demo tick
+	EndTick       int              `json:"endTick"`       // demo tick
+	IngameTick    int              `json:"ingameTick"`    // in-game tick of the first segment
+	ServerTick    int              `json:"serverTick"`    // server tick of the first segment
+	Round         int              `json:"round"`         // 0 if the utterance is not during a round
+	Outputs       []ManifestOutput `json:"outputs"`
+}
+
+type Manifest struct {
+	Demo            string              `json:"demo"`
+	Game            Game                `json:"game"`
+	Mode            Mode                `json:"mode"`
+	DurationSeconds float64             `json:"durationSeconds"`
+	Window          *TimeWindow         `json:"window,omitempty"` // extracted part of the demo with -start or -end
+	TickRate        float64             `json:"tickRate"`         // demo ticks per second
+	Timebase        Timebase            `json:"timebase"`
+	Speakers        []ManifestSpeaker   `json:"speakers"`
+	Rounds          []Round             `json:"rounds"`
+	Utterances      []ManifestUtterance `json:"utterances"`
+}
+
+func GetRoundNumber(rounds []Round, timestamp float64) int {
+	for _, round := range rounds {
+		if timestamp >= round.StartTime && timestamp <= round.EndTime {
+			return round.Number
+		}
+	}
+
+	return 0
+}
+
+// BuildManifest describes the utterances of the result, options.Placements must contain the placements recorded while
+// generating the audio files.
+func BuildManifest(result *Result, segmentsPerPlayer map[string][]VoiceSegment, tickRate float64, options ExtractOptions) Manifest {
+	manifest := Manifest{
+		Demo:            options.DemoName,
+		Game:            result.Game,
+		Mode:            options.Mode,
+		DurationSeconds: result.DurationSeconds,
+		Window:          result.Window,
+		TickRate:        tickRate,
+		Timebase:        options.Timebase,
+		Speakers:        make([]ManifestSpeaker, 0, len(result.Players)),
+		Rounds:          result.Rounds,
+		Utterances:      make([]ManifestUtterance, 0),
+	}
+	if manifest.Rounds == nil {
+		manifest.Rounds = make([]Round, 0)
+	}
+
+	steamIDs := make(map[string]uint64, len(result.Players))
+	for _, player := range result.Players {
+		steamIDs[player.ID] = player.SteamID
+		manifest.Speakers = append(manifest.Speakers, ManifestSpeaker{
+			SteamID:     player.SteamID,
+			Name:        player.Name,
+			ID:          player.ID,
+			LostPackets: player.LostPackets,
+			LatePackets: player.LatePackets,
+			LossRate:    player.GetLossRate(),
+		})
+	}
+
+	for _, utterance := range options.GetUtterances(segmentsPerPlayer) {
+		endTime := options.Placements.GetUtteranceEndTime(utterance)
+		outputs := make([]ManifestOutput, 0)
+		// an utterance starts at the first segment written in the file
+		outputFiles := make(map[string]bool)
+		for _, segment := range utterance.Segments {
+			for _, placement := range options.Placements.get(segment) {
+				if outputFiles[placement.File] {
+					continue
+				}
+
+				outputFiles[placement.File] = true
+				outputs = append(outputs, ManifestOutput{
+					File:         placement.File,
+					SampleOffset: placement.Position,
+					SampleRate:   placement.SampleRate,
+				})
+			}
+		}
+
+		manifest.Utterances = append(manifest.Utterances, ManifestUtterance{
+			SteamID:       steamIDs[utterance.PlayerID],
+			StartTime:     utterance.StartTime,
+			EndTime:       endTime,
+			DemoStartTime: result.GetDemoTime(utterance.StartTime),
+			DemoEndTime:   result.GetDemoTime(endTime),
+			StartTick:     utterance.StartTick,
+			EndTick:       getUtteranceEndTick(utterance, endTime, tickRate),
+			IngameTick:    utterance.Segments[0].Tick,
+			ServerTick:    utterance.Segments[0].ServerTick,
+			Round:         GetRoundNumber(result.Rounds, utterance.StartTime),
+			Outputs:       outputs,
+		})
+	}
+
+	return manifest
+}
+
+// WriteManifest writes <demoName>.voice.json in the output folder and returns its path.
+func WriteManifest(result *Result, segmentsPerPlayer map[string][]VoiceSegment, tickRate float64, options ExtractOptions) (string, error) {
+	path := filepath.Join(options.OutputPath, options.DemoName+".voice.json")
+	err := WriteJSONFile(path, BuildManifest(result, segmentsPerPlayer, tickRate, options))
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
@@ -0,0 +1,175 @@
+package common
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type MarkerFormat string
+
+const (
+	MarkerFormatNone     MarkerFormat = ""
+	MarkerFormatReaper   MarkerFormat = "reaper"   // CSV of the Reaper region/marker manager
+	MarkerFormatAudition MarkerFormat = "audition" // tab-separated CSV of the Adobe Audition markers panel
+)
+
+var MarkerFormats = []MarkerFormat{MarkerFormatReaper, MarkerFormatAudition}
+
+func (format MarkerFormat) IsValid() bool {
+	return format == MarkerFormatNone || slices.Contains(MarkerFormats, format)
+}
+
+// Marker is an utterance (region) or a round boundary (point, StartTime equals EndTime) on the demo timeline.
+type Marker struct {
+	StartTime float64 // in seconds
+	EndTime   float64 // in seconds
+	Name      string
+}
+
+func (marker Marker) IsRegion() bool {
+	return marker.EndTime > marker.StartTime
+}
+
+// BuildMarkers returns the utterances labelled with the player's name and the rounds boundaries sorted by time.
+func BuildMarkers(result *Result, segmentsPerPlayer map[string][]VoiceSegment, options ExtractOptions) []Marker {
+	names := make(map[string]string, len(result.Players))
+	for _, player := range result.Players {
+		names[player.ID] = player.Name
+	}
+
+	markers := make([]Marker, 0)
+	for _, round := range result.Rounds {
+		markers = append(markers, Marker{
+			StartTime: round.StartTime,
+			EndTime:   round.StartTime,
+			Name:      fmt.Sprintf("Round %d start", round.Number),
+		}, Marker{
+			StartTime: round.EndTime,
+			EndTime:   round.EndTime,
+			Name:      fmt.Sprintf("Round %d end", round.Number),
+		})
+	}
+
+	for _, utterance := range options.GetUtterances(segmentsPerPlayer) {
+		markers = append(markers, Marker{
+			StartTime: utterance.StartTime,
+			EndTime:   options.Placements.GetUtteranceEndTime(utterance),
+			Name:      names[utterance.PlayerID],
+		})
+	}
+
+	slices.SortStableFunc(markers, func(a, b Marker) int {
+		if a.StartTime < b.StartTime {
+			return -1
+		}
+		if a.StartTime > b.StartTime {
+			return 1
+		}
+		return 0
+	})
+
+	return markers
+}
+
+// FormatAudacityLabels formats the markers as an Audacity label track: start, end and label separated by tabs.
+func FormatAudacityLabels(markers []Marker) string {
+	var builder strings.Builder
+	for _, marker := range markers {
+		fmt.Fprintf(&builder, "%.6f\t%.6f\t%s\n", marker.StartTime, marker.EndTime, marker.Name)
+	}
+
+	return builder.String()
+}
+
+// formatAuditionTime formats seconds as [h:]m:ss.mmm, the decimal time format of Adobe Audition.
+func formatAuditionTime(seconds float64) string {
+	milliseconds := int64(seconds*1000 + 0.5)
+	hours := milliseconds / 3600000
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d.%03d", hours, milliseconds/60000%60, milliseconds/1000%60, milliseconds%1000)
+	}
+
+	return fmt.Sprintf("%d:%02d.%03d", milliseconds/60000, milliseconds/1000%60, milliseconds%1000)
+}
+
+func writeMarkersCSV(path string, markers []Marker, format MarkerFormat) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return NewWavFileCreationError("Couldn't create markers file", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	if format == MarkerFormatAudition {
+		writer.Comma = '\t'
+		err = writer.Write([]string{"Name", "Start", "Duration", "Time Format", "Type", "Description"})
+		for _, marker := range markers {
+			if err != nil {
+				break
+			}
+			err = writer.Write([]string{marker.Name, formatAuditionTime(marker.StartTime), formatAuditionTime(marker.EndTime - marker.StartTime), "decimal", "Cue", ""})
+		}
+	} else {
+		err = writer.Write([]string{"#", "Name", "Start", "End", "Length"})
+		// Reaper numbers markers and regions separately
+		markerCount, regionCount := 0, 0
+		for _, marker := range markers {
+			if err != nil {
+				break
+			}
+
+			if marker.IsRegion() {
+				regionCount++
+				err = writer.Write([]string{fmt.Sprintf("R%d", regionCount), marker.Name, fmt.Sprintf("%.3f", marker.StartTime), fmt.Sprintf("%.3f", marker.EndTime), fmt.Sprintf("%.3f", marker.EndTime-marker.StartTime)})
+			} else {
+				markerCount++
+				err = writer.Write([]string{fmt.Sprintf("M%d", markerCount), marker.Name, fmt.Sprintf("%.3f", marker.StartTime), "", ""})
+			}
+		}
+	}
+
+	if err == nil {
+		writer.Flush()
+		err = writer.Error()
+	}
+	if err != nil {
+		return NewWavFileCreationError("Couldn't write markers file", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return NewWavFileCreationError("Couldn't close markers file", err)
+	}
+
+	return nil
+}
+
+// WriteMarkers writes the Audacity labels <demoName>.labels.txt when options.Labels is true and the markers
+// <demoName>.markers.csv when options.Markers is set, it returns the paths of the written files.
+func WriteMarkers(result *Result, segmentsPerPlayer map[string][]VoiceSegment, options ExtractOptions) ([]string, error) {
+	markers := BuildMarkers(result, segmentsPerPlayer, options)
+	files := make([]string, 0, 2)
+	if options.Labels {
+		path := filepath.Join(options.OutputPath, options.DemoName+".labels.txt")
+		err := os.WriteFile(path, []byte(FormatAudacityLabels(markers)), 0644)
+		if err != nil {
+			return files, NewWavFileCreationError("Couldn't write labels file", err)
+		}
+		files = append(files, path)
+	}
+
+	if options.Markers != MarkerFormatNone {
+		path := filepath.Join(options.OutputPath, options.DemoName+".markers.csv")
+		err := writeMarkersCSV(path, markers, options.Markers)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, path)
+	}
+
+	return files, nil
+}
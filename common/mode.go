@@ -1,9 +1,49 @@
 package common
 
+import "slices"
+
 type Mode string
 
 const (
 	ModeSplitCompact Mode = "split-compact" // 1 wav file per player that contains all of the player's voice lines in one continuous sequence without silence
 	ModeSplitFull    Mode = "split-full"    // 1 wav file per player that contains all of the player's voice lines in one continuous sequence with silence (demo length)
 	ModeSingleFull   Mode = "single-full"   // Single wav file that contains all of the voice lines from all players in one continuous sequence with silence (demo length)
+	ModeMultitrack   Mode = "multitrack"    // Single multichannel wav file with 1 channel per player (demo length) and a channel map sidecar
+	ModeSplitRounds  Mode = "split-rounds"  // 1 wav file per round that contains the voice lines of all players with silence (round length)
+	ModeClips        Mode = "clips"         // 1 wav file per utterance, an utterance is a group of voice segments of a player without long gaps
+	ModeSplitTeam    Mode = "split-team"    // 1 wav file per team that contains the voice lines of its players with silence (demo length)
+)
+
+var Modes = []Mode{ModeSplitCompact, ModeSplitFull, ModeSingleFull, ModeMultitrack, ModeSplitRounds, ModeClips, ModeSplitTeam}
+
+func (mode Mode) IsValid() bool {
+	return slices.Contains(Modes, mode)
+}
+
+// IsDemoTimeline returns true if the mode writes files that have the demo duration with voices at their demo time.
+func (mode Mode) IsDemoTimeline() bool {
+	return mode == ModeSplitFull || mode == ModeSingleFull || mode == ModeMultitrack
+}
+
+type Format string
+
+const (
+	FormatWav  Format = "wav"
+	FormatFlac Format = "flac"
+	FormatOpus Format = "opus" // Ogg Opus files containing the original CS2 Opus packets, not decoded and not re-encoded
 )
+
+var Formats = []Format{FormatWav, FormatFlac, FormatOpus}
+
+func (format Format) IsValid() bool {
+	return slices.Contains(Formats, format)
+}
+
+// SupportsMode returns false if the mode requires to decode voices and the format can't re-encode them.
+func (format Format) SupportsMode(mode Mode) bool {
+	if format == FormatOpus {
+		return mode == ModeSplitCompact || mode == ModeSplitFull || mode == ModeClips
+	}
+
+	return true
+}
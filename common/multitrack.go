@@ -0,0 +1,121 @@
+package common
+
+import "path/filepath"
+
+// TrackSegment contains decoded samples placed at their position in a multitrack output.
+type TrackSegment struct {
+	Segment  VoiceSegment
+	Position int // in samples
+	Samples  []int
+}
+
+type Channel struct {
+	Index   int    `json:"index"` // 0-based channel index in the audio file
+	SteamID uint64 `json:"steamId,string"`
+	Name    string `json:"name"`
+	ID      string `json:"id"`
+}
+
+// ChannelMap describes which player is on each channel of a multitrack file.
+type ChannelMap struct {
+	File       string    `json:"file"`
+	SampleRate int       `json:"sampleRate"`
+	Channels   []Channel `json:"channels"`
+}
+
+// GenerateMultitrackFile writes a demo-length file with 1 channel per player and its channel map
+// <demoName>.channels.json in the output folder. Tracks must be in the same order as players and their segments
+// sorted by position without overlap.
+func GenerateMultitrackFile(tracks [][]TrackSegment, players []Player, format AudioFormat, totalSamples int, options ExtractOptions) ([]string, error) {
+	format.NumChannels = len(tracks)
+	sink, err := options.CreateMultitrackSink(format)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeTracks(sink, format, tracks, totalSamples)
+	err = CloseSink(sink, err)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, track := range tracks {
+		for _, segment := range track {
+			options.Placements.Record(segment.Segment, sink, segment.Position, len(segment.Samples), format.SampleRate)
+		}
+	}
+
+	files := make([]string, 0, 2)
+	audioPath := GetSinkPath(sink)
+	if audioPath != "" {
+		files = append(files, audioPath)
+	}
+
+	channelMap := ChannelMap{
+		File:       filepath.Base(audioPath),
+		SampleRate: format.SampleRate,
+		Channels:   make([]Channel, 0, len(players)),
+	}
+	if audioPath == "" {
+		channelMap.File = options.DemoName
+	}
+	for index, player := range players {
+		channelMap.Channels = append(channelMap.Channels, Channel{
+			Index:   index,
+			SteamID: player.SteamID,
+			Name:    player.Name,
+			ID:      player.ID,
+		})
+	}
+
+	channelMapPath := filepath.Join(options.OutputPath, options.DemoName+".channels.json")
+	err = WriteJSONFile(channelMapPath, channelMap)
+	if err != nil {
+		return files, err
+	}
+
+	return append(files, channelMapPath), nil
+}
+
+// writeTracks interleaves the tracks in small chunks to avoid large memory allocations.
+func writeTracks(sink AudioSink, format AudioFormat, tracks [][]TrackSegment, totalSamples int) error {
+	const chunkSize = 8192
+	numChannels := len(tracks)
+	// index of the first segment of each track that may overlap with the current chunk
+	segmentIndexes := make([]int, numChannels)
+	for chunkStart := 0; chunkStart < totalSamples; chunkStart += chunkSize {
+		chunkEnd := min(chunkStart+chunkSize, totalSamples)
+		data := make([]int, (chunkEnd-chunkStart)*numChannels)
+		for channel, track := range tracks {
+			for segmentIndexes[channel] < len(track) {
+				segment := track[segmentIndexes[channel]]
+				if segment.Position >= chunkEnd {
+					break
+				}
+
+				segmentEnd := segment.Position + len(segment.Samples)
+				overlapStart := max(segment.Position, chunkStart)
+				overlapEnd := min(segmentEnd, chunkEnd)
+				for i := overlapStart; i < overlapEnd; i++ {
+					data[(i-chunkStart)*numChannels+channel] = segment.Samples[i-segment.Position]
+				}
+
+				if segmentEnd > chunkEnd {
+					break
+				}
+				segmentIndexes[channel]++
+			}
+		}
+
+		err := sink.Write(AudioFrame{
+			Position:  chunkStart,
+			Timestamp: float64(chunkStart) / float64(format.SampleRate),
+			Data:      data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// GetMergedChannelCount returns the number of channels of merged outputs, 2 when options.Stereo is true or when a
+// POV player is set.
+func (options ExtractOptions) GetMergedChannelCount() int {
+	if options.Stereo || options.POVSteamID != 0 {
+		return 2
+	}
+
+	return 1
+}
+
+// GetPan returns the position of the segment in the stereo mix from -1 (left) to 1 (right). The player's pan from
+// options.Pans is used if set, then the position from the POV player, CT are on the left and T on the right otherwise.
+func (options ExtractOptions) GetPan(segment VoiceSegment) float64 {
+	if pan, ok := options.Pans[segment.SteamID]; ok {
+		return max(-1, min(1, pan))
+	}
+
+	if segment.Spatial != nil {
+		return segment.Spatial.Pan
+	}
+
+	switch segment.Side {
+	case "CT":
+		return -1
+	case "T":
+		return 1
+	default:
+		return 0
+	}
+}
+
+// GetChannelGains returns the gain of the segment in each channel of merged outputs using a constant power pan law,
+// attenuated by the distance from the POV player.
+func (options ExtractOptions) GetChannelGains(segment VoiceSegment) []float64 {
+	if options.GetMergedChannelCount() == 1 {
+		return []float64{1}
+	}
+
+	angle := (options.GetPan(segment) + 1) * math.Pi / 4
+	left, right := math.Cos(angle), math.Sin(angle)
+	// avoid tiny values instead of silence for hard panned voices
+	if left < 1e-9 {
+		left = 0
+	}
+	if right < 1e-9 {
+		right = 0
+	}
+
+	if segment.Spatial != nil {
+		left *= segment.Spatial.Gain
+		right *= segment.Spatial.Gain
+	}
+
+	return []float64{left, right}
+}
+
+// ParsePans parses a comma-separated list of steamID=pan, i.e. 76561198123456789=-0.5,76561198123456780=1.
+func ParsePans(value string) (map[uint64]float64, error) {
+	pans := make(map[uint64]float64)
+	if value == "" {
+		return pans, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		steamID, pan, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			return nil, NewInvalidArgumentError("Invalid pan, the format is steamID=pan: "+entry, nil)
+		}
+
+		id, err := strconv.ParseUint(steamID, 10, 64)
+		if err != nil {
+			return nil, NewInvalidArgumentError("Invalid pan Steam ID: "+steamID, err)
+		}
+
+		pans[id], err = strconv.ParseFloat(pan, 64)
+		if err != nil || pans[id] < -1 || pans[id] > 1 {
+			return nil, NewInvalidArgumentError("Invalid pan value, it must be between -1 and 1: "+pan, err)
+		}
+	}
+
+	return pans, nil
+}
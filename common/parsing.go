@@ -2,45 +2,189 @@ package common
 
 import (
 	"fmt"
-	"os"
+	"io"
 	"regexp"
+	"slices"
+	"strings"
 
 	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
+	demcommon "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/common"
 )
 
 type ExtractOptions struct {
-	DemoPath   string
-	DemoName   string
-	File       *os.File
-	OutputPath string
-	Mode       Mode
-	SteamIDs   []string
+	DemoPath    string // only used in messages, can be empty
+	DemoName    string // used to name output files
+	OutputPath  string
+	Mode        Mode
+	Format      Format // audio file format used when SinkFactory is nil, WAV by default
+	SteamIDs    []string
+	Log         io.Writer        // progress and warning messages are discarded when nil
+	SinkFactory AudioSinkFactory // WAV files are written in OutputPath when nil
+	// with the split-rounds mode, also write 1 file per player and round in addition to the merged round file
+	SplitRoundsPerPlayer bool
+	// with the clips mode, segments separated by less than this duration (in seconds) belong to the same utterance,
+	// DefaultClipGapSeconds when 0
+	ClipGapSeconds float64
+	Manifest       bool // write <demoName>.voice.json describing every utterance
+	Subtitles      bool // write <demoName>.srt and <demoName>.vtt with the single-full mode
+	// write the Audacity label track <demoName>.labels.txt with the split-full, single-full and multitrack modes
+	Labels bool
+	// write <demoName>.markers.csv with the split-full, single-full and multitrack modes, none by default
+	Markers MarkerFormat
+	// write <demoName>.events.json, the game events timeline with the events nearby each utterance
+	Events             bool
+	EventWindowSeconds float64 // DefaultEventWindowSeconds when 0
+	AliveFilter        AliveFilter
+	// with the split-compact and split-full modes, write the segments sent while the player was alive and dead in
+	// separate files
+	SplitAliveDead bool
+	TeamKey        TeamKey // how files are grouped with the split-team mode, by side by default
+	// mix merged outputs in stereo with CT on the left and T on the right
+	Stereo bool
+	Pans   map[uint64]float64 // pan per SteamID from -1 (left) to 1 (right) with Stereo, overrides the team pan
+	// mix merged outputs in stereo as heard by this player, only the voices of their teammates are kept
+	POVSteamID uint64
+	// extract only the part of the demo between Start and End, outputs start at Start
+	Start TimeBound
+	End   TimeBound
+	// clock used for all the times, TimebaseTime by default
+	Timebase Timebase
+	// remove the warmup from the outputs timeline
+	SkipWarmup bool
+	// shorten silences during pauses and timeouts to PauseGapSeconds
+	CollapsePauses  bool
+	PauseGapSeconds float64 // 0 removes the silences entirely, the CLI uses DefaultPauseGapSeconds
+	// write a script to jump to every utterance in the game, none by default
+	Playback PlaybackFormat
+	// how lost CS2 Opus voice packets are concealed, ConcealmentOff by default
+	Concealment PacketLossConcealment
+	// collects where voice segments are written, set when sidecar files are written
+	Placements *PlacementRecorder
+}
+
+func (options ExtractOptions) Logf(format string, args ...any) {
+	if options.Log == nil {
+		return
+	}
+
+	fmt.Fprintf(options.Log, format, args...)
+}
+
+type Game string
+
+const (
+	GameCSGO Game = "CSGO"
+	GameCS2  Game = "CS2"
+)
+
+type Player struct {
+	SteamID      uint64
+	Name         string
+	ID           string // name and SteamID, used in file names
+	SegmentCount int
+	LostPackets  int // voice packets detected as lost, CS2 Opus only
+	LatePackets  int // voice packets received after the following ones, or twice, dropped with concealment, CS2 Opus only
+}
+
+type Result struct {
+	Game            Game
+	DurationSeconds float64
+	Players         []Player
+	Rounds          []Round
+	Events          []GameEvent // kills, bomb and round events sorted by time
+	Window          *TimeWindow // extracted part of the demo when ExtractOptions.Start or End is set, times are relative to its start
+	Timeline        *Timeline   // maps the times to the demo when the warmup is skipped or pauses are collapsed
+	Files           []string    // paths of the written audio files
+}
+
+// SortPlayers returns the players sorted by ID with their segment count.
+func SortPlayers(players map[string]Player, segmentsPerPlayer map[string][]VoiceSegment) []Player {
+	sortedPlayers := make([]Player, 0, len(players))
+	for playerID, player := range players {
+		player.SegmentCount = len(segmentsPerPlayer[playerID])
+		for _, segment := range segmentsPerPlayer[playerID] {
+			player.LostPackets += segment.LostPackets
+		}
+		sortedPlayers = append(sortedPlayers, player)
+	}
+
+	slices.SortFunc(sortedPlayers, func(a, b Player) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return sortedPlayers
 }
 
 type VoiceSegment struct {
-	Data      []byte
-	Timestamp float64 // in seconds
+	Data        []byte
+	Timestamp   float64 // in seconds
+	Tick        int     // in-game tick
+	ServerTick  int     // server tick of the last net_Tick message
+	DemoTick    int     // demo tick (frame), the tick used by demo_gototick
+	IsAlive     bool    // whether the speaker was alive when the segment has been sent
+	Side        string  // CT or T when the segment has been sent, empty if the speaker wasn't on a team
+	TeamName    string  // clan name or team_<starting side> when the segment has been sent
+	SteamID     uint64
+	PlayerID    string
+	Index       int              // index in the player's segments
+	Spatial     *SpatialPosition // where the segment is heard from the POV player, nil without POV
+	LostPackets int              // number of packets of the speaker lost right before this one, CS2 Opus only
 }
 
-var playerNameCache = make(map[uint64]string)
+var invalidFileNameCharsRegex = regexp.MustCompile(`[\\/:*?"<>|]`)
 
-func GetPlayerID(parser dem.Parser, steamID uint64) string {
-	if name, ok := playerNameCache[steamID]; ok {
-		return fmt.Sprintf("%s_%d", name, steamID)
+// SanitizeFileName removes the characters that are not allowed in file names.
+func SanitizeFileName(name string) string {
+	return invalidFileNameCharsRegex.ReplaceAllString(name, "")
+}
+
+// PlayerNameCache keeps the first name found for each player so that a player renamed during the demo keeps the
+// same ID. A cache must be used for a single demo because demos may be processed concurrently.
+type PlayerNameCache map[uint64]string
+
+func NewPlayerNameCache() PlayerNameCache {
+	return make(PlayerNameCache)
+}
+
+func (cache PlayerNameCache) GetPlayerName(parser dem.Parser, steamID uint64) string {
+	if name, ok := cache[steamID]; ok {
+		return name
 	}
 
-	playerName := ""
 	for _, player := range parser.GameState().Participants().All() {
 		if player.SteamID64 == steamID {
-			invalidCharsRegex := regexp.MustCompile(`[\\/:*?"<>|]`)
-			playerName = invalidCharsRegex.ReplaceAllString(player.Name, "")
-			playerNameCache[steamID] = playerName
-			break
+			playerName := SanitizeFileName(player.Name)
+			if playerName != "" {
+				cache[steamID] = playerName
+			}
+			return playerName
 		}
 	}
 
+	return ""
+}
+
+// FindPlayer returns nil if the player is not connected.
+func FindPlayer(parser dem.Parser, steamID uint64) *demcommon.Player {
+	for _, player := range parser.GameState().Participants().All() {
+		if player.SteamID64 == steamID {
+			return player
+		}
+	}
+
+	return nil
+}
+
+func IsPlayerAlive(parser dem.Parser, steamID uint64) bool {
+	player := FindPlayer(parser, steamID)
+
+	return player != nil && player.IsAlive()
+}
+
+// GetPlayerID returns an empty string if the player's name can't be found.
+func (cache PlayerNameCache) GetPlayerID(parser dem.Parser, steamID uint64) string {
+	playerName := cache.GetPlayerName(parser, steamID)
 	if playerName == "" {
-		fmt.Println("Unable to find player's name with SteamID", steamID)
 		return ""
 	}
 
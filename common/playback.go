@@ -0,0 +1,157 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type PlaybackFormat string
+
+const (
+	PlaybackFormatNone PlaybackFormat = ""
+	PlaybackFormatCfg  PlaybackFormat = "cfg" // config file with voice_next/voice_prev aliases, CS2 and CSGO
+	PlaybackFormatVdm  PlaybackFormat = "vdm" // demo actions file that plays only the utterances, CSGO
+)
+
+var PlaybackFormats = []PlaybackFormat{PlaybackFormatCfg, PlaybackFormatVdm}
+
+func (format PlaybackFormat) IsValid() bool {
+	return format == PlaybackFormatNone || slices.Contains(PlaybackFormats, format)
+}
+
+// PlaybackEntry is an utterance to jump to in the game.
+type PlaybackEntry struct {
+	StartTick int // demo tick, used by demo_gototick and the demo actions
+	EndTick   int
+	DemoTime  float64 // in seconds from the start of the demo
+	Name      string
+	Round     int // 0 if the utterance is not during a round
+}
+
+// getUtteranceEndTick returns the demo tick at which the last decoded sample of the utterance is played.
+func getUtteranceEndTick(utterance Utterance, endTime float64, tickRate float64) int {
+	endTick := utterance.Segments[len(utterance.Segments)-1].DemoTick
+	if tickRate > 0 {
+		endTick = max(endTick, utterance.StartTick+int(math.Round((endTime-utterance.StartTime)*tickRate)))
+	}
+
+	return endTick
+}
+
+// BuildPlaybackEntries returns the utterances sorted by start tick, tickRate is the number of demo ticks per second.
+func BuildPlaybackEntries(result *Result, segmentsPerPlayer map[string][]VoiceSegment, tickRate float64, options ExtractOptions) []PlaybackEntry {
+	names := make(map[string]string, len(result.Players))
+	for _, player := range result.Players {
+		names[player.ID] = player.Name
+	}
+
+	entries := make([]PlaybackEntry, 0)
+	for _, utterance := range options.GetUtterances(segmentsPerPlayer) {
+		endTime := options.Placements.GetUtteranceEndTime(utterance)
+		entries = append(entries, PlaybackEntry{
+			StartTick: utterance.StartTick,
+			EndTick:   getUtteranceEndTick(utterance, endTime, tickRate),
+			DemoTime:  result.GetDemoTime(utterance.StartTime),
+			Name:      names[utterance.PlayerID],
+			Round:     GetRoundNumber(result.Rounds, utterance.StartTime),
+		})
+	}
+
+	slices.SortStableFunc(entries, func(a, b PlaybackEntry) int {
+		return a.StartTick - b.StartTick
+	})
+
+	return entries
+}
+
+// sanitizeCommandArgument removes the characters that would end a console command argument.
+func sanitizeCommandArgument(value string) string {
+	return strings.NewReplacer(`"`, "", ";", "", "\n", " ", "\r", " ").Replace(value)
+}
+
+func formatDemoTime(seconds float64) string {
+	milliseconds := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", milliseconds/3600000, milliseconds/60000%60, milliseconds/1000%60, milliseconds%1000)
+}
+
+func (entry PlaybackEntry) describe() string {
+	description := fmt.Sprintf("%s at %s tick %d", sanitizeCommandArgument(entry.Name), formatDemoTime(entry.DemoTime), entry.StartTick)
+	if entry.Round > 0 {
+		description += fmt.Sprintf(" round %d", entry.Round)
+	}
+
+	return description
+}
+
+// FormatPlaybackConfig returns a config file that defines the aliases voice_next and voice_prev to jump from an
+// utterance to another with demo_gototick.
+func FormatPlaybackConfig(entries []PlaybackEntry, demoName string) string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "// Voice lines of %s, exec this file while the demo is playing and use voice_next and voice_prev.\n", demoName)
+	builder.WriteString("// i.e. bind \"n\" voice_next; bind \"b\" voice_prev\n")
+	for index, entry := range entries {
+		number := index + 1
+		nextNumber := min(number+1, len(entries))
+		previousNumber := max(number-1, 1)
+		fmt.Fprintf(&builder, "alias voice_%d \"demo_gototick %d; echo [%d/%d] %s; alias voice_next voice_%d; alias voice_prev voice_%d\"\n",
+			number, entry.StartTick, number, len(entries), entry.describe(), nextNumber, previousNumber)
+	}
+
+	if len(entries) > 0 {
+		builder.WriteString("alias voice_next voice_1\n")
+		builder.WriteString("alias voice_prev voice_1\n")
+	}
+	fmt.Fprintf(&builder, "echo \"%d voice lines loaded, use voice_next and voice_prev\"\n", len(entries))
+
+	return builder.String()
+}
+
+// FormatVDM returns demo actions that skip from an utterance to the next one and print the speaker's name, so the
+// demo plays only the utterances. Overlapping utterances are played once.
+func FormatVDM(entries []PlaybackEntry) string {
+	var builder strings.Builder
+	builder.WriteString("demoactions\n{\n")
+	actionCount := 0
+	writeAction := func(factory string, name string, fields ...string) {
+		actionCount++
+		fmt.Fprintf(&builder, "\t\"%d\"\n\t{\n\t\tfactory \"%s\"\n\t\tname \"%s\"\n", actionCount, factory, name)
+		for index := 0; index < len(fields)-1; index += 2 {
+			fmt.Fprintf(&builder, "\t\t%s \"%s\"\n", fields[index], fields[index+1])
+		}
+		builder.WriteString("\t}\n")
+	}
+
+	playedTick := 0
+	for index, entry := range entries {
+		if entry.StartTick > playedTick {
+			writeAction("SkipAhead", fmt.Sprintf("Skip to voice %d", index+1), "starttick", fmt.Sprint(playedTick), "skiptotick", fmt.Sprint(entry.StartTick))
+		}
+		writeAction("PlayCommands", fmt.Sprintf("Voice %d", index+1), "starttick", fmt.Sprint(entry.StartTick), "commands", "echo "+entry.describe())
+		playedTick = max(playedTick, entry.EndTick)
+	}
+	builder.WriteString("}\n")
+
+	return builder.String()
+}
+
+// WritePlaybackScript writes <demoName>.voice.cfg or <demoName>.vdm according to options.Playback and returns its path.
+func WritePlaybackScript(result *Result, segmentsPerPlayer map[string][]VoiceSegment, tickRate float64, options ExtractOptions) (string, error) {
+	entries := BuildPlaybackEntries(result, segmentsPerPlayer, tickRate, options)
+	path := filepath.Join(options.OutputPath, options.DemoName+".voice.cfg")
+	content := FormatPlaybackConfig(entries, options.DemoName)
+	if options.Playback == PlaybackFormatVdm {
+		path = filepath.Join(options.OutputPath, options.DemoName+".vdm")
+		content = FormatVDM(entries)
+	}
+
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		return "", NewWavFileCreationError("Couldn't write playback script", err)
+	}
+
+	return path, nil
+}
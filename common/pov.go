@@ -0,0 +1,116 @@
+package common
+
+import (
+	"math"
+
+	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
+	demcommon "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/common"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/events"
+)
+
+const (
+	// distance in game units under which voices are not attenuated in the POV mix
+	povReferenceDistance = 500.0
+	// voices are radio comms, far teammates must remain audible
+	povMinGain = 0.25
+)
+
+// SpatialPosition is where a voice segment is heard from the POV player.
+type SpatialPosition struct {
+	Pan  float64 // from -1 (left) to 1 (right)
+	Gain float64 // distance attenuation from povMinGain to 1
+}
+
+// POVTracker keeps the last known team of every player so that voices are still attributed to a team while a
+// player is not connected.
+type POVTracker struct {
+	parser     dem.Parser
+	povSteamID uint64
+	teams      map[uint64]demcommon.Team
+}
+
+func NewPOVTracker(parser dem.Parser, options ExtractOptions) *POVTracker {
+	tracker := &POVTracker{
+		parser:     parser,
+		povSteamID: options.POVSteamID,
+		teams:      make(map[uint64]demcommon.Team),
+	}
+
+	parser.RegisterEventHandler(func(event events.PlayerTeamChange) {
+		if event.Player != nil {
+			tracker.updateTeam(event.Player.SteamID64, event.NewTeam)
+		}
+	})
+
+	return tracker
+}
+
+// updateTeam records the team if the player is playing, spectators and unassigned players keep their last team.
+func (tracker *POVTracker) updateTeam(steamID uint64, team demcommon.Team) {
+	if team == demcommon.TeamCounterTerrorists || team == demcommon.TeamTerrorists {
+		tracker.teams[steamID] = team
+	}
+}
+
+// findPlayer returns the player if connected and updates their last known team.
+func (tracker *POVTracker) findPlayer(steamID uint64) *demcommon.Player {
+	player := FindPlayer(tracker.parser, steamID)
+	if player != nil {
+		tracker.updateTeam(steamID, player.Team)
+	}
+
+	return player
+}
+
+// GetSpatialPosition returns where the speaker is heard from the POV player at the current tick. It returns nil when
+// no POV player is set or when the speaker is not heard by the POV player: enemies, players whose team is unknown and
+// dead teammates while the POV player is alive. Voices are centered and not attenuated when the speaker or the POV
+// player is dead or not connected.
+func (tracker *POVTracker) GetSpatialPosition(speakerSteamID uint64) *SpatialPosition {
+	if tracker.povSteamID == 0 {
+		return nil
+	}
+
+	centered := &SpatialPosition{
+		Pan:  0,
+		Gain: 1,
+	}
+	listener := tracker.findPlayer(tracker.povSteamID)
+	if speakerSteamID == tracker.povSteamID {
+		return centered
+	}
+
+	speaker := tracker.findPlayer(speakerSteamID)
+	listenerTeam, isListenerTeamKnown := tracker.teams[tracker.povSteamID]
+	if !isListenerTeamKnown || tracker.teams[speakerSteamID] != listenerTeam {
+		return nil
+	}
+
+	if listener == nil || speaker == nil {
+		return centered
+	}
+
+	if !speaker.IsAlive() && listener.IsAlive() {
+		// alive players can't hear dead teammates in-game
+		return nil
+	}
+
+	if !speaker.IsAlive() || !listener.IsAlive() {
+		return centered
+	}
+
+	listenerPosition := listener.Position()
+	speakerPosition := speaker.Position()
+	deltaX := speakerPosition.X - listenerPosition.X
+	deltaY := speakerPosition.Y - listenerPosition.Y
+	distance := speakerPosition.Sub(listenerPosition).Norm()
+
+	// the yaw is counterclockwise, a speaker on the left has a positive relative angle
+	yaw := float64(listener.ViewDirectionX()) * math.Pi / 180
+	relativeAngle := math.Atan2(deltaY, deltaX) - yaw
+
+	return &SpatialPosition{
+		Pan:  -math.Sin(relativeAngle),
+		Gain: max(povMinGain, min(1, povReferenceDistance/max(distance, 1))),
+	}
+}
@@ -0,0 +1,152 @@
+package common
+
+import (
+	"fmt"
+
+	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/events"
+)
+
+type Round struct {
+	Number            int     `json:"number"`
+	StartTime         float64 `json:"startTime"`         // in seconds
+	FreezetimeEndTime float64 `json:"freezetimeEndTime"` // in seconds, 0 if the freeze time end wasn't found
+	EndTime           float64 `json:"endTime"`           // in seconds
+}
+
+// RoundTracker collects the rounds boundaries while the demo is parsed. Warmup rounds are ignored and a restarted
+// round replaces the previous one with the same number.
+type RoundTracker struct {
+	parser  dem.Parser
+	clock   *Clock
+	rounds  []Round
+	current *Round
+}
+
+func NewRoundTracker(parser dem.Parser, clock *Clock) *RoundTracker {
+	tracker := &RoundTracker{
+		parser: parser,
+		clock:  clock,
+	}
+
+	parser.RegisterEventHandler(tracker.onRoundStart)
+	parser.RegisterEventHandler(tracker.onRoundFreezetimeEnd)
+	parser.RegisterEventHandler(tracker.onRoundEnd)
+
+	return tracker
+}
+
+func (tracker *RoundTracker) currentTime() float64 {
+	return tracker.clock.Seconds()
+}
+
+func (tracker *RoundTracker) onRoundStart(events.RoundStart) {
+	if tracker.parser.GameState().IsWarmupPeriod() {
+		return
+	}
+
+	tracker.endCurrentRound()
+	number := tracker.parser.GameState().TotalRoundsPlayed() + 1
+	// the round has been restarted
+	if len(tracker.rounds) > 0 && tracker.rounds[len(tracker.rounds)-1].Number >= number {
+		tracker.rounds = tracker.rounds[:len(tracker.rounds)-1]
+	}
+
+	tracker.current = &Round{
+		Number:    number,
+		StartTime: tracker.currentTime(),
+	}
+}
+
+func (tracker *RoundTracker) onRoundFreezetimeEnd(events.RoundFreezetimeEnd) {
+	if tracker.current != nil {
+		tracker.current.FreezetimeEndTime = tracker.currentTime()
+	}
+}
+
+func (tracker *RoundTracker) onRoundEnd(events.RoundEnd) {
+	tracker.endCurrentRound()
+}
+
+func (tracker *RoundTracker) endCurrentRound() {
+	if tracker.current == nil {
+		return
+	}
+
+	tracker.current.EndTime = tracker.currentTime()
+	tracker.rounds = append(tracker.rounds, *tracker.current)
+	tracker.current = nil
+}
+
+// Rounds returns the rounds found, a round without end event ends at the given demo duration.
+func (tracker *RoundTracker) Rounds(durationSeconds float64) []Round {
+	rounds := tracker.rounds
+	if tracker.current != nil {
+		round := *tracker.current
+		round.EndTime = durationSeconds
+		rounds = append(rounds, round)
+	}
+
+	return rounds
+}
+
+func BuildRoundOutputName(demoName string, roundNumber int) string {
+	return fmt.Sprintf("%s_round%d", demoName, roundNumber)
+}
+
+// SliceSegments returns the segments that start during the time range with timestamps relative to its start.
+func SliceSegments(segmentsPerPlayer map[string][]VoiceSegment, startTime float64, endTime float64) map[string][]VoiceSegment {
+	slicedSegmentsPerPlayer := make(map[string][]VoiceSegment)
+	for playerID, segments := range segmentsPerPlayer {
+		for _, segment := range segments {
+			if segment.Timestamp < startTime || segment.Timestamp >= endTime {
+				continue
+			}
+
+			segment.Timestamp -= startTime
+			slicedSegmentsPerPlayer[playerID] = append(slicedSegmentsPerPlayer[playerID], segment)
+		}
+	}
+
+	return slicedSegmentsPerPlayer
+}
+
+// RoundFilesGenerator writes the audio files of a round, segments timestamps are relative to the round start.
+type RoundFilesGenerator func(segmentsPerPlayer map[string][]VoiceSegment, durationSeconds float64, options ExtractOptions) ([]string, error)
+
+// GetRoundFileEndTime returns the end of the round file: voices sent after the round end, while the scoreboard is
+// shown, belong to the round until the next round starts. The last round file ends at the end of the demo.
+func GetRoundFileEndTime(rounds []Round, index int, durationSeconds float64) float64 {
+	if index+1 < len(rounds) {
+		return max(rounds[index].EndTime, rounds[index+1].StartTime)
+	}
+
+	return max(rounds[index].EndTime, durationSeconds)
+}
+
+// GenerateRoundFiles calls the generator for each round that contains voice data with the output name
+// <demoName>_round<N>, see GetRoundFileEndTime.
+func GenerateRoundFiles(segmentsPerPlayer map[string][]VoiceSegment, rounds []Round, durationSeconds float64, options ExtractOptions, generate RoundFilesGenerator) ([]string, error) {
+	if len(rounds) == 0 {
+		return nil, NewError(fmt.Sprintf("No rounds found in demo %s\n", options.DemoPath), nil, ParsingError)
+	}
+
+	files := make([]string, 0, len(rounds))
+	for index, round := range rounds {
+		endTime := GetRoundFileEndTime(rounds, index, durationSeconds)
+		roundSegments := SliceSegments(segmentsPerPlayer, round.StartTime, endTime)
+		if len(roundSegments) == 0 {
+			continue
+		}
+
+		roundOptions := options
+		roundOptions.DemoName = BuildRoundOutputName(options.DemoName, round.Number)
+		roundFiles, err := generate(roundSegments, endTime-round.StartTime, roundOptions)
+		files = append(files, roundFiles...)
+		if err != nil {
+			return files, err
+		}
+	}
+
+	return files, nil
+}
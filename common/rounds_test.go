@@ -0,0 +1,51 @@
+package common
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestGenerateRoundFilesKeepsVoicesSentAfterTheRoundEnd(t *testing.T) {
+	rounds := []Round{
+		{Number: 1, StartTime: 10, EndTime: 100},
+		{Number: 2, StartTime: 107, EndTime: 200},
+	}
+	segmentsPerPlayer := map[string][]VoiceSegment{
+		"player": {
+			{Timestamp: 5},   // warmup, before the first round
+			{Timestamp: 50},  // round 1
+			{Timestamp: 103}, // round 1 end, before round 2 starts
+			{Timestamp: 150}, // round 2
+			{Timestamp: 204}, // round 2 end, before the end of the demo
+		},
+	}
+
+	type roundFile struct {
+		timestamps      []float64
+		durationSeconds float64
+	}
+	roundFiles := make(map[string]roundFile)
+	_, err := GenerateRoundFiles(segmentsPerPlayer, rounds, 210, ExtractOptions{DemoName: "demo"}, func(roundSegments map[string][]VoiceSegment, durationSeconds float64, options ExtractOptions) ([]string, error) {
+		file := roundFile{durationSeconds: durationSeconds}
+		for _, segment := range roundSegments["player"] {
+			file.timestamps = append(file.timestamps, segment.Timestamp)
+		}
+		roundFiles[options.DemoName] = file
+
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]roundFile{
+		"demo_round1": {timestamps: []float64{40, 93}, durationSeconds: 97},
+		"demo_round2": {timestamps: []float64{43, 97}, durationSeconds: 103},
+	}
+	if !maps.EqualFunc(roundFiles, expected, func(a, b roundFile) bool {
+		return slices.Equal(a.timestamps, b.timestamps) && a.durationSeconds == b.durationSeconds
+	}) {
+		t.Fatalf("got %v, want %v", roundFiles, expected)
+	}
+}
@@ -0,0 +1,65 @@
+package common
+
+// HasSidecarFiles returns true if files describing the voices have to be written alongside the audio files.
+func (options ExtractOptions) HasSidecarFiles() bool {
+	return options.Manifest || options.Events || (options.Subtitles && options.Mode == ModeSingleFull) || options.hasMarkers() || options.Playback != PlaybackFormatNone
+}
+
+func (options ExtractOptions) hasMarkers() bool {
+	return (options.Labels || options.Markers != MarkerFormatNone) && options.Mode.IsDemoTimeline()
+}
+
+// WriteSidecarFiles writes the files describing the voices that have been enabled in the options once the audio files
+// have been generated and returns their paths. tickRate is the number of demo ticks per second.
+func WriteSidecarFiles(result *Result, segmentsPerPlayer map[string][]VoiceSegment, tickRate float64, options ExtractOptions) ([]string, error) {
+	files := make([]string, 0)
+	if result.Timeline != nil {
+		timelinePath, err := WriteTimeline(result.Timeline, options)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, timelinePath)
+	}
+
+	if options.Manifest {
+		manifestPath, err := WriteManifest(result, segmentsPerPlayer, tickRate, options)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, manifestPath)
+	}
+
+	if options.Events {
+		timelinePath, err := WriteEventTimeline(result, segmentsPerPlayer, options)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, timelinePath)
+	}
+
+	if options.Subtitles && options.Mode == ModeSingleFull {
+		subtitleFiles, err := WriteSubtitles(result, segmentsPerPlayer, options)
+		files = append(files, subtitleFiles...)
+		if err != nil {
+			return files, err
+		}
+	}
+
+	if options.hasMarkers() {
+		markerFiles, err := WriteMarkers(result, segmentsPerPlayer, options)
+		files = append(files, markerFiles...)
+		if err != nil {
+			return files, err
+		}
+	}
+
+	if options.Playback != PlaybackFormatNone {
+		playbackPath, err := WritePlaybackScript(result, segmentsPerPlayer, tickRate, options)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, playbackPath)
+	}
+
+	return files, nil
+}
@@ -0,0 +1,244 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/go-audio/audio"
+	"github.com/go-audio/wav"
+)
+
+// AudioFormat describes the PCM samples sent to an AudioSink.
+type AudioFormat struct {
+	SampleRate  int
+	NumChannels int
+	BitDepth    int // samples are signed integers using the full range of this bit depth
+}
+
+// AudioFrame contains interleaved PCM samples.
+type AudioFrame struct {
+	Position int // position of the first sample in the output, in samples per channel
+	// Timestamp is the time of the first sample in seconds on the output timeline. It's the demo time unless a time
+	// range or collapsed pauses shift the outputs. In compact outputs, it's the time at which the segment was sent.
+	Timestamp float64
+	Data      []int
+}
+
+type SinkKind string
+
+const (
+	SinkKindPlayer     SinkKind = "player"     // voice of a single player
+	SinkKindMerged     SinkKind = "merged"     // voices of several players mixed together
+	SinkKindMultitrack SinkKind = "multitrack" // 1 channel per player, in the order of the channel map
+	SinkKindClip       SinkKind = "clip"       // single utterance of a player
+)
+
+type AudioSinkInfo struct {
+	Kind   SinkKind
+	Name   string  // output name without extension, i.e. demoName_playerID
+	Player *Player // nil when Kind is SinkKindMerged or SinkKindMultitrack
+	Format AudioFormat
+}
+
+// AudioSink receives the PCM frames of an output in order. Frames positions never go backward, a frame that starts
+// after the end of the previous one means that there is silence between them.
+type AudioSink interface {
+	Write(frame AudioFrame) error
+	Close() error
+}
+
+type AudioSinkFactory func(info AudioSinkInfo) (AudioSink, error)
+
+// FileSink is implemented by sinks that write a file on the disk.
+type FileSink interface {
+	Path() string
+}
+
+func BuildPlayerOutputName(demoName string, playerID string) string {
+	return fmt.Sprintf("%s_%s", demoName, playerID)
+}
+
+func (options ExtractOptions) CreatePlayerSink(player Player, format AudioFormat) (AudioSink, error) {
+	return options.CreateSink(AudioSinkInfo{
+		Kind:   SinkKindPlayer,
+		Name:   BuildPlayerOutputName(options.DemoName, player.ID),
+		Player: &player,
+		Format: format,
+	})
+}
+
+func (options ExtractOptions) CreateMergedSink(format AudioFormat) (AudioSink, error) {
+	return options.CreateSink(AudioSinkInfo{
+		Kind:   SinkKindMerged,
+		Name:   options.DemoName,
+		Format: format,
+	})
+}
+
+func (options ExtractOptions) CreateMultitrackSink(format AudioFormat) (AudioSink, error) {
+	return options.CreateSink(AudioSinkInfo{
+		Kind:   SinkKindMultitrack,
+		Name:   options.DemoName,
+		Format: format,
+	})
+}
+
+// CloseSink closes the sink and returns err if not nil, the error returned by Close otherwise.
+func CloseSink(sink AudioSink, err error) error {
+	closeErr := sink.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// CreateSink creates a sink using the options' SinkFactory, files using the options' format are written in the output
+// folder by default.
+func (options ExtractOptions) CreateSink(info AudioSinkInfo) (AudioSink, error) {
+	if options.SinkFactory != nil {
+		return options.SinkFactory(info)
+	}
+
+	if options.Format == FormatFlac {
+		if info.Format.NumChannels <= flacMaxChannels {
+			return NewFlacFileSinkFactory(options.OutputPath)(info)
+		}
+
+		// the number of players is known only once the demo has been parsed, fall back to WAV instead of failing
+		options.Logf("Warning: FLAC supports up to %d channels, %s is written as a WAV file with %d channels\n", flacMaxChannels, info.Name, info.Format.NumChannels)
+	}
+
+	return NewWavFileSinkFactory(options.OutputPath)(info)
+}
+
+// GetSinkPath returns the path of the file written by the sink or an empty string if the sink doesn't write a file.
+func GetSinkPath(sink AudioSink) string {
+	if fileSink, ok := sink.(FileSink); ok {
+		return fileSink.Path()
+	}
+
+	return ""
+}
+
+type WavSink struct {
+	encoder         *wav.Encoder
+	format          AudioFormat
+	writtenPosition int
+}
+
+// NewWavSink writes PCM frames as a WAV stream, Close must be called to write the final WAV header.
+func NewWavSink(writer io.WriteSeeker, format AudioFormat) *WavSink {
+	return &WavSink{
+		encoder: wav.NewEncoder(writer, format.SampleRate, format.BitDepth, format.NumChannels, 1),
+		format:  format,
+	}
+}
+
+func (sink *WavSink) Write(frame AudioFrame) error {
+	// fill the gap with silence
+	if frame.Position > sink.writtenPosition {
+		err := WriteSilence(sink, sink.format, sink.writtenPosition, frame.Position)
+		if err != nil {
+			return err
+		}
+	}
+
+	return sink.write(frame.Data)
+}
+
+func (sink *WavSink) write(data []int) error {
+	buf := &audio.IntBuffer{
+		Data: data,
+		Format: &audio.Format{
+			SampleRate:  sink.format.SampleRate,
+			NumChannels: sink.format.NumChannels,
+		},
+	}
+
+	if err := sink.encoder.Write(buf); err != nil {
+		return NewWavFileCreationError("Couldn't write WAV file", err)
+	}
+
+	sink.writtenPosition += len(data) / sink.format.NumChannels
+
+	return nil
+}
+
+func (sink *WavSink) Close() error {
+	if err := sink.encoder.Close(); err != nil {
+		return NewWavFileCreationError("Couldn't write WAV file", err)
+	}
+
+	return nil
+}
+
+type WavFileSink struct {
+	*WavSink
+	file *os.File
+}
+
+func NewWavFileSink(path string, format AudioFormat) (*WavFileSink, error) {
+	file, err := CreateWavFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WavFileSink{
+		WavSink: NewWavSink(file, format),
+		file:    file,
+	}, nil
+}
+
+func (sink *WavFileSink) Path() string {
+	return sink.file.Name()
+}
+
+func (sink *WavFileSink) Close() error {
+	err := sink.WavSink.Close()
+	closeErr := sink.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if closeErr != nil {
+		return NewWavFileCreationError("Couldn't close WAV file", closeErr)
+	}
+
+	return nil
+}
+
+func NewWavFileSinkFactory(outputPath string) AudioSinkFactory {
+	return func(info AudioSinkInfo) (AudioSink, error) {
+		path := filepath.Join(outputPath, info.Name+".wav")
+		// each player is on its own track, even with 1 or 2 players that would be opened as a mono or stereo track
+		if info.Kind == SinkKindMultitrack {
+			return NewExtensibleWavFileSink(path, info.Format)
+		}
+
+		return NewWavFileSink(path, info.Format)
+	}
+}
+
+// WriteSilence writes silent frames from the position up to the end position in small chunks to avoid large memory
+// allocations.
+func WriteSilence(sink AudioSink, format AudioFormat, position int, endPosition int) error {
+	const silenceBufferSize = 8192
+	silenceBuffer := make([]int, silenceBufferSize*format.NumChannels)
+	for position < endPosition {
+		length := min(endPosition-position, silenceBufferSize)
+		err := sink.Write(AudioFrame{
+			Position:  position,
+			Timestamp: float64(position) / float64(format.SampleRate),
+			Data:      silenceBuffer[:length*format.NumChannels],
+		})
+		if err != nil {
+			return err
+		}
+		position += length
+	}
+
+	return nil
+}
@@ -0,0 +1,507 @@
+package common
+
+import (
+	"cmp"
+	"slices"
+)
+
+// MergedChunkSize is the number of samples per channel mixed at once in merged outputs.
+const MergedChunkSize = 8192
+
+// SegmentDecoder returns the PCM samples of a voice segment, samples are empty for silent segments. Each speaker
+// (SteamID) is decoded with its own state, so segments of several speakers may be interleaved.
+type SegmentDecoder func(segment VoiceSegment) ([]float32, error)
+
+// MixedSegment is a decoded voice segment placed in a merged output.
+type MixedSegment struct {
+	Segment  VoiceSegment
+	Position int // position of the first sample in the output, in samples per channel
+	Samples  []float32
+	Gains    []float64 // gain in each channel
+}
+
+// End returns the position of the sample following the last sample of the segment.
+func (segment MixedSegment) End() int {
+	return segment.Position + len(segment.Samples)
+}
+
+// ChunkMixer returns the interleaved samples of the chunk [chunkStart, chunkEnd[ of a merged output from the segments
+// that may overlap with it.
+type ChunkMixer func(segments []MixedSegment, chunkStart int, chunkEnd int, numChannels int) []int
+
+// WriteMixedChunks mixes the segments chunk by chunk up to totalSamples and writes the chunks in the sink. Segments
+// are swept by start position so that each chunk goes only through the segments that overlap with it, they are given
+// to mixChunk in their order in segments so that the mix is the same as with all the segments.
+func WriteMixedChunks(sink AudioSink, segments []MixedSegment, totalSamples int, format AudioFormat, mixChunk ChunkMixer) error {
+	// indexes of the segments sorted by start position
+	startOrder := make([]int, len(segments))
+	for index := range startOrder {
+		startOrder[index] = index
+	}
+	slices.SortStableFunc(startOrder, func(a, b int) int {
+		return cmp.Compare(segments[a].Position, segments[b].Position)
+	})
+
+	nextIndex := 0
+	activeIndexes := make([]int, 0)
+	activeSegments := make([]MixedSegment, 0)
+	for chunkStart := 0; chunkStart < totalSamples; chunkStart += MergedChunkSize {
+		chunkEnd := min(chunkStart+MergedChunkSize, totalSamples)
+		hasNewSegments := false
+		for nextIndex < len(startOrder) && segments[startOrder[nextIndex]].Position < chunkEnd {
+			activeIndexes = append(activeIndexes, startOrder[nextIndex])
+			nextIndex++
+			hasNewSegments = true
+		}
+		if hasNewSegments {
+			slices.Sort(activeIndexes)
+		}
+
+		activeSegments = activeSegments[:0]
+		for _, index := range activeIndexes {
+			activeSegments = append(activeSegments, segments[index])
+		}
+
+		err := sink.Write(AudioFrame{
+			Position:  chunkStart,
+			Timestamp: float64(chunkStart) / float64(format.SampleRate),
+			Data:      mixChunk(activeSegments, chunkStart, chunkEnd, format.NumChannels),
+		})
+		if err != nil {
+			return err
+		}
+
+		// drop the segments that end before the next chunk
+		activeIndexes = slices.DeleteFunc(activeIndexes, func(index int) bool {
+			return segments[index].End() <= chunkEnd
+		})
+	}
+
+	return nil
+}
+
+// VoiceCodec describes how the voice segments of a game are decoded and mixed.
+type VoiceCodec struct {
+	Format     AudioFormat // format of a single player's output, mono
+	NewDecoder func() (SegmentDecoder, error)
+	// ToInts converts decoded samples to samples of Format.BitDepth
+	ToInts   func(samples []float32) []int
+	MixChunk ChunkMixer
+}
+
+// CanStreamVoices returns true when the voice segments can be decoded and written while the demo is parsed with the
+// split-compact, split-full or single-full mode. The segments are kept in memory and written once the demo has been
+// parsed, with the same output, when:
+//   - the format is opus, packets are muxed without being decoded
+//   - a start or an end is set, the placement in the outputs depends on the time range that is known only once it's
+//     over and the voices sent outside of it are dropped
+//   - the warmup is skipped or the pauses are collapsed, the timeline is built from the whole demo
+func (options ExtractOptions) CanStreamVoices() bool {
+	isStreamedMode := options.Mode == ModeSplitCompact || options.Mode == ModeSplitFull || options.Mode == ModeSingleFull
+
+	return isStreamedMode && options.Format != FormatOpus && !options.Start.IsSet() && !options.End.IsSet() &&
+		!options.SkipWarmup && !options.CollapsePauses
+}
+
+// PlayerVoiceWriter writes the voice of a player as its segments are received in time order. With the full length,
+// segments are written at their timestamps and the output has the demo duration, otherwise they are written one after
+// the other. Only the samples placed after the timestamp of the last segment received, which may exceed the demo
+// duration, are kept in memory until Close is called.
+type PlayerVoiceWriter struct {
+	player              Player
+	codec               VoiceCodec
+	options             ExtractOptions
+	isFullLength        bool
+	decode              SegmentDecoder
+	sink                AudioSink
+	position            int // end of the samples written in the sink
+	previousEndPosition int
+	pending             []MixedSegment // the first segment may have been partially written
+}
+
+func NewPlayerVoiceWriter(player Player, codec VoiceCodec, isFullLength bool, options ExtractOptions) (*PlayerVoiceWriter, error) {
+	decode, err := codec.NewDecoder()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PlayerVoiceWriter{
+		player:       player,
+		codec:        codec,
+		options:      options,
+		isFullLength: isFullLength,
+		decode:       decode,
+	}, nil
+}
+
+func (writer *PlayerVoiceWriter) writeSamples(position int, timestamp float64, samples []float32) error {
+	err := WriteSilence(writer.sink, writer.codec.Format, writer.position, position)
+	if err != nil {
+		return err
+	}
+
+	if writer.isFullLength {
+		timestamp = float64(position) / float64(writer.codec.Format.SampleRate)
+	}
+	err = writer.sink.Write(AudioFrame{
+		Position:  position,
+		Timestamp: timestamp,
+		Data:      writer.codec.ToInts(samples),
+	})
+	if err != nil {
+		return err
+	}
+	writer.position = position + len(samples)
+
+	return nil
+}
+
+// writePending writes the pending samples placed before endPosition, a segment that overlaps with endPosition is
+// split and its remaining samples are kept.
+func (writer *PlayerVoiceWriter) writePending(endPosition int) error {
+	for len(writer.pending) > 0 {
+		segment := writer.pending[0]
+		startPosition := max(segment.Position, writer.position)
+		segmentEndPosition := min(segment.End(), endPosition)
+		if segmentEndPosition <= startPosition {
+			return nil
+		}
+
+		err := writer.writeSamples(startPosition, segment.Segment.Timestamp, segment.Samples[startPosition-segment.Position:segmentEndPosition-segment.Position])
+		if err != nil {
+			return err
+		}
+
+		if segmentEndPosition < segment.End() {
+			return nil
+		}
+
+		writer.options.Placements.Record(segment.Segment, writer.sink, segment.Position, len(segment.Samples), writer.codec.Format.SampleRate)
+		writer.pending = writer.pending[1:]
+	}
+
+	return nil
+}
+
+// Write decodes the segment and writes the samples that can't exceed the demo duration.
+func (writer *PlayerVoiceWriter) Write(segment VoiceSegment) error {
+	// the file is created even if the player's segments are all silent
+	if writer.sink == nil {
+		sink, err := writer.options.CreatePlayerSink(writer.player, writer.codec.Format)
+		if err != nil {
+			return err
+		}
+		writer.sink = sink
+	}
+
+	samples, err := writer.decode(segment)
+	if err != nil {
+		writer.options.Logf("%s\n", err)
+		return nil
+	}
+
+	if len(samples) == 0 {
+		return nil
+	}
+
+	if !writer.isFullLength {
+		position := writer.position
+		err = writer.writeSamples(position, segment.Timestamp, samples)
+		if err != nil {
+			return err
+		}
+		writer.options.Placements.Record(segment, writer.sink, position, len(samples), writer.codec.Format.SampleRate)
+
+		return nil
+	}
+
+	sampleRate := writer.codec.Format.SampleRate
+	currentPosition := int(segment.Timestamp * float64(sampleRate))
+	startPosition := max(currentPosition, writer.previousEndPosition)
+	segment.Data = nil
+	writer.pending = append(writer.pending, MixedSegment{
+		Segment:  segment,
+		Position: startPosition,
+		Samples:  samples,
+	})
+	writer.previousEndPosition = startPosition + len(samples)
+
+	// the demo lasts at least until the current segment, the samples placed before it are not truncated
+	return writer.writePending(currentPosition)
+}
+
+// Close writes the remaining samples and silence up to the demo duration with the full length and closes the output.
+// It returns the path of the written file, nothing is written if the player has no segments. When err is not nil,
+// the output is closed without writing anything else and err is returned.
+func (writer *PlayerVoiceWriter) Close(durationSeconds float64, err error) (string, error) {
+	if writer.sink == nil {
+		return "", err
+	}
+
+	if err == nil && writer.isFullLength {
+		totalSamples := int(durationSeconds * float64(writer.codec.Format.SampleRate))
+		writer.pending = slices.DeleteFunc(writer.pending, func(segment MixedSegment) bool {
+			if segment.Position < totalSamples {
+				return false
+			}
+
+			writer.options.Logf("Warning: Voice segment at %f seconds exceeds demo duration\n", segment.Segment.Timestamp)
+			return true
+		})
+
+		// truncate the segment if it exceeds the demo duration
+		for index, segment := range writer.pending {
+			if segment.End() > totalSamples {
+				writer.pending[index].Samples = segment.Samples[:totalSamples-segment.Position]
+			}
+		}
+
+		err = writer.writePending(totalSamples)
+		writer.pending = nil
+
+		// write remaining silence at the end of the file
+		if err == nil {
+			err = WriteSilence(writer.sink, writer.codec.Format, writer.position, totalSamples)
+		}
+	}
+
+	return GetSinkPath(writer.sink), CloseSink(writer.sink, err)
+}
+
+// MergedVoiceWriter mixes the voices of all players as their segments are received in time order, the output has
+// the demo duration. Chunks are mixed and written as soon as no segment received later can overlap with them, only
+// the segments that overlap with the chunks not written yet are kept in memory.
+type MergedVoiceWriter struct {
+	codec                VoiceCodec
+	options              ExtractOptions
+	format               AudioFormat
+	sink                 AudioSink
+	decode               SegmentDecoder
+	previousEndPositions map[string]int
+	segments             []MixedSegment
+	chunkStart           int
+}
+
+func NewMergedVoiceWriter(codec VoiceCodec, options ExtractOptions) *MergedVoiceWriter {
+	format := codec.Format
+	format.NumChannels = options.GetMergedChannelCount()
+
+	return &MergedVoiceWriter{
+		codec:                codec,
+		options:              options,
+		format:               format,
+		previousEndPositions: make(map[string]int),
+	}
+}
+
+// writeChunk mixes and writes the chunk that ends at chunkEnd and drops the segments that end before it.
+func (writer *MergedVoiceWriter) writeChunk(chunkEnd int) error {
+	err := writer.sink.Write(AudioFrame{
+		Position:  writer.chunkStart,
+		Timestamp: float64(writer.chunkStart) / float64(writer.format.SampleRate),
+		Data:      writer.codec.MixChunk(writer.segments, writer.chunkStart, chunkEnd, writer.format.NumChannels),
+	})
+	if err != nil {
+		return err
+	}
+
+	writer.chunkStart = chunkEnd
+	writer.segments = slices.DeleteFunc(writer.segments, func(segment MixedSegment) bool {
+		if segment.End() > chunkEnd {
+			return false
+		}
+
+		writer.options.Placements.Record(segment.Segment, writer.sink, segment.Position, len(segment.Samples), writer.format.SampleRate)
+		return true
+	})
+
+	return nil
+}
+
+// Write decodes the segment and writes the chunks that end before its timestamp.
+func (writer *MergedVoiceWriter) Write(segment VoiceSegment) error {
+	if writer.sink == nil {
+		sink, err := writer.options.CreateMergedSink(writer.format)
+		if err != nil {
+			return err
+		}
+		writer.sink = sink
+	}
+
+	if writer.decode == nil {
+		decode, err := writer.codec.NewDecoder()
+		if err != nil {
+			return err
+		}
+		writer.decode = decode
+	}
+
+	sampleRate := writer.format.SampleRate
+	currentPosition := int(segment.Timestamp * float64(sampleRate))
+	samples, err := writer.decode(segment)
+	if err != nil {
+		writer.options.Logf("%s\n", err)
+	} else if len(samples) > 0 {
+		startPosition := max(currentPosition, writer.previousEndPositions[segment.PlayerID])
+		segment.Data = nil
+		writer.segments = append(writer.segments, MixedSegment{
+			Segment:  segment,
+			Position: startPosition,
+			Samples:  samples,
+			Gains:    writer.options.GetChannelGains(segment),
+		})
+		writer.previousEndPositions[segment.PlayerID] = startPosition + len(samples)
+	}
+
+	// the demo lasts at least until the current segment and segments received later start after it
+	for writer.chunkStart+MergedChunkSize <= currentPosition {
+		err = writer.writeChunk(writer.chunkStart + MergedChunkSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close writes the remaining chunks up to the demo duration and closes the output. It returns the path of the
+// written file. When err is not nil, the output is closed without writing anything else and err is returned.
+func (writer *MergedVoiceWriter) Close(durationSeconds float64, err error) (string, error) {
+	if writer.sink == nil {
+		return "", err
+	}
+
+	if err == nil {
+		totalSamples := int(durationSeconds * float64(writer.format.SampleRate))
+		writer.segments = slices.DeleteFunc(writer.segments, func(segment MixedSegment) bool {
+			if segment.Position < totalSamples {
+				return false
+			}
+
+			writer.options.Logf("Warning: Voice segment at %f seconds exceeds demo duration\n", segment.Segment.Timestamp)
+			return true
+		})
+		for _, segment := range writer.segments {
+			writer.options.Placements.Record(segment.Segment, writer.sink, segment.Position, min(len(segment.Samples), totalSamples-segment.Position), writer.format.SampleRate)
+		}
+
+		for writer.chunkStart < totalSamples && err == nil {
+			err = writer.sink.Write(AudioFrame{
+				Position:  writer.chunkStart,
+				Timestamp: float64(writer.chunkStart) / float64(writer.format.SampleRate),
+				Data:      writer.codec.MixChunk(writer.segments, writer.chunkStart, min(writer.chunkStart+MergedChunkSize, totalSamples), writer.format.NumChannels),
+			})
+			writer.chunkStart += MergedChunkSize
+		}
+		writer.segments = nil
+	}
+
+	return GetSinkPath(writer.sink), CloseSink(writer.sink, err)
+}
+
+// VoiceStream decodes and writes the voice segments while the demo is parsed with the split-compact, split-full and
+// single-full modes, so that the voice data of the whole demo is never kept in memory.
+type VoiceStream struct {
+	codec   VoiceCodec
+	options ExtractOptions
+	writers map[string]*PlayerVoiceWriter // per player file ID
+	fileIDs []string                      // in order of creation
+	merged  *MergedVoiceWriter
+}
+
+func NewVoiceStream(codec VoiceCodec, options ExtractOptions) *VoiceStream {
+	stream := &VoiceStream{
+		codec:   codec,
+		options: options,
+		writers: make(map[string]*PlayerVoiceWriter),
+	}
+
+	if options.Mode == ModeSingleFull {
+		stream.merged = NewMergedVoiceWriter(codec, options)
+	}
+
+	return stream
+}
+
+// Write writes the segment of the player if it's kept by the filters, segments must be written in time order.
+func (stream *VoiceStream) Write(segment VoiceSegment, player Player) error {
+	if !stream.options.KeepSegment(segment) {
+		return nil
+	}
+
+	if stream.merged != nil {
+		return stream.merged.Write(segment)
+	}
+
+	fileID := stream.options.GetPlayerFileID(player.ID, segment)
+	writer := stream.writers[fileID]
+	if writer == nil {
+		player.ID = fileID
+		var err error
+		writer, err = NewPlayerVoiceWriter(player, stream.codec, stream.options.Mode == ModeSplitFull, stream.options)
+		if err != nil {
+			return err
+		}
+		stream.writers[fileID] = writer
+		stream.fileIDs = append(stream.fileIDs, fileID)
+	}
+
+	return writer.Write(segment)
+}
+
+// Close completes and closes all the outputs and returns the paths of the written files. When err is not nil, the
+// outputs are closed without writing anything else and err is returned.
+func (stream *VoiceStream) Close(durationSeconds float64, err error) ([]string, error) {
+	files := make([]string, 0, len(stream.fileIDs))
+	addFile := func(path string, closeErr error) {
+		if path != "" {
+			files = append(files, path)
+		}
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	if stream.merged != nil {
+		addFile(stream.merged.Close(durationSeconds, err))
+	}
+
+	for _, fileID := range stream.fileIDs {
+		addFile(stream.writers[fileID].Close(durationSeconds, err))
+	}
+
+	return files, err
+}
+
+// WritePlayerFiles writes 1 file per player from segments already collected, see PlayerVoiceWriter.
+func WritePlayerFiles(segmentsPerPlayer map[string][]VoiceSegment, players map[string]Player, codec VoiceCodec, isFullLength bool, durationSeconds float64, options ExtractOptions) ([]string, error) {
+	files := make([]string, 0, len(segmentsPerPlayer))
+	for playerID, segments := range segmentsPerPlayer {
+		if len(segments) == 0 {
+			continue
+		}
+
+		writer, err := NewPlayerVoiceWriter(players[playerID], codec, isFullLength, options)
+		if err != nil {
+			return files, err
+		}
+
+		for _, segment := range segments {
+			err = writer.Write(segment)
+			if err != nil {
+				break
+			}
+		}
+
+		file, err := writer.Close(durationSeconds, err)
+		if err != nil {
+			return files, err
+		}
+
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,337 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// memorySink keeps the frames written in memory.
+type memorySink struct {
+	positions []int
+	data      []int
+}
+
+func (sink *memorySink) Write(frame AudioFrame) error {
+	sink.positions = append(sink.positions, frame.Position)
+	sink.data = append(sink.data, frame.Data...)
+
+	return nil
+}
+
+func (sink *memorySink) Close() error {
+	return nil
+}
+
+// discardSink drops the frames written.
+type discardSink struct{}
+
+func (discardSink) Write(AudioFrame) error {
+	return nil
+}
+
+func (discardSink) Close() error {
+	return nil
+}
+
+var mixFormat = AudioFormat{
+	SampleRate:  48000,
+	NumChannels: 2,
+	BitDepth:    32,
+}
+
+// buildMixedSegments returns segments of random length, position and gains that overlap with each other, in random
+// order.
+func buildMixedSegments(count int) ([]MixedSegment, int) {
+	random := rand.New(rand.NewPCG(uint64(count), 42))
+	totalSamples := count * MergedChunkSize / 4
+	segments := make([]MixedSegment, 0, count)
+	for index := range count {
+		// from a few samples to several chunks
+		length := 1 + random.IntN(MergedChunkSize*3)
+		samples := make([]float32, length)
+		for sampleIndex := range samples {
+			if random.IntN(8) != 0 {
+				samples[sampleIndex] = random.Float32()*2 - 1
+			}
+		}
+
+		gains := []float64{random.Float64(), random.Float64()}
+		if index%5 == 0 {
+			gains[random.IntN(2)] = 0
+		}
+
+		segments = append(segments, MixedSegment{
+			Segment: VoiceSegment{
+				PlayerID: fmt.Sprint(index % 10),
+				Index:    index,
+			},
+			Position: random.IntN(totalSamples),
+			Samples:  samples,
+			Gains:    gains,
+		})
+	}
+
+	return segments, totalSamples
+}
+
+// sumChunk mixes like the game mixers: samples are summed in float32 in the order of the segments, so the mix depends
+// on the order, and the chunk is normalized by its peak.
+func sumChunk(segments []MixedSegment, chunkStart int, chunkEnd int, numChannels int) []int {
+	samples := make([]float32, (chunkEnd-chunkStart)*numChannels)
+	for _, segment := range segments {
+		for position := max(segment.Position, chunkStart); position < min(segment.End(), chunkEnd); position++ {
+			for channel, gain := range segment.Gains {
+				samples[(position-chunkStart)*numChannels+channel] += segment.Samples[position-segment.Position] * float32(gain)
+			}
+		}
+	}
+
+	peak := float32(1)
+	for _, sample := range samples {
+		peak = max(peak, sample, -sample)
+	}
+
+	ints := make([]int, len(samples))
+	for index, sample := range samples {
+		ints[index] = int(sample / peak * math.MaxInt32)
+	}
+
+	return ints
+}
+
+// writeAllSegmentsPerChunk is the previous mix that gave all the segments to mixChunk for every chunk.
+func writeAllSegmentsPerChunk(sink AudioSink, segments []MixedSegment, totalSamples int, format AudioFormat, mixChunk ChunkMixer) error {
+	for chunkStart := 0; chunkStart < totalSamples; chunkStart += MergedChunkSize {
+		chunkEnd := min(chunkStart+MergedChunkSize, totalSamples)
+		err := sink.Write(AudioFrame{
+			Position:  chunkStart,
+			Timestamp: float64(chunkStart) / float64(format.SampleRate),
+			Data:      mixChunk(segments, chunkStart, chunkEnd, format.NumChannels),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestWriteMixedChunksMatchesAllSegmentsMix(t *testing.T) {
+	for _, count := range []int{0, 1, 10, 200} {
+		t.Run(fmt.Sprint(count), func(t *testing.T) {
+			segments, totalSamples := buildMixedSegments(count)
+			// the mix must not depend on chunks that don't contain any segment
+			totalSamples += MergedChunkSize*2 + 17
+
+			expected := &memorySink{}
+			err := writeAllSegmentsPerChunk(expected, segments, totalSamples, mixFormat, sumChunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := &memorySink{}
+			err = WriteMixedChunks(actual, segments, totalSamples, mixFormat, sumChunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(actual.positions, expected.positions) {
+				t.Fatalf("chunk positions differ: got %v, want %v", actual.positions, expected.positions)
+			}
+			if len(actual.data) != totalSamples*mixFormat.NumChannels {
+				t.Fatalf("got %d samples, want %d", len(actual.data), totalSamples*mixFormat.NumChannels)
+			}
+			for index := range expected.data {
+				if actual.data[index] != expected.data[index] {
+					t.Fatalf("sample %d differs: got %d, want %d", index, actual.data[index], expected.data[index])
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteMixedChunks(b *testing.B) {
+	for _, count := range []int{100, 1000, 10000} {
+		segments, totalSamples := buildMixedSegments(count)
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			for b.Loop() {
+				err := WriteMixedChunks(discardSink{}, segments, totalSamples, mixFormat, sumChunk)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkWriteAllSegmentsPerChunk measures the previous mix to compare it with BenchmarkWriteMixedChunks, each chunk
+// goes through all the segments.
+func BenchmarkWriteAllSegmentsPerChunk(b *testing.B) {
+	for _, count := range []int{100, 1000, 10000} {
+		segments, totalSamples := buildMixedSegments(count)
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			for b.Loop() {
+				err := writeAllSegmentsPerChunk(discardSink{}, segments, totalSamples, mixFormat, sumChunk)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// sampleCodec decodes a segment into as many samples as bytes in its data, each sample is the segment index + 1.
+var sampleCodec = VoiceCodec{
+	Format: AudioFormat{
+		SampleRate:  1000,
+		NumChannels: 1,
+		BitDepth:    32,
+	},
+	NewDecoder: func() (SegmentDecoder, error) {
+		return func(segment VoiceSegment) ([]float32, error) {
+			samples := make([]float32, len(segment.Data))
+			for index := range samples {
+				samples[index] = float32(segment.Index + 1)
+			}
+
+			return samples, nil
+		}, nil
+	},
+	ToInts: func(samples []float32) []int {
+		ints := make([]int, len(samples))
+		for index, sample := range samples {
+			ints[index] = int(sample)
+		}
+
+		return ints
+	},
+}
+
+func newMemorySinkOptions(sinks map[string]*memorySink, mode Mode) ExtractOptions {
+	return ExtractOptions{
+		DemoName: "demo",
+		Mode:     mode,
+		SinkFactory: func(info AudioSinkInfo) (AudioSink, error) {
+			sink := &memorySink{}
+			sinks[info.Name] = sink
+
+			return sink, nil
+		},
+	}
+}
+
+func TestPlayerVoiceWriterWritesSamplesPlacedBeforeTheCurrentSegment(t *testing.T) {
+	// segments are sent every 100ms and last 150ms, the voice runs ahead of the demo
+	const segmentCount = 20
+	const durationSeconds = 2.5
+	segments := make([]VoiceSegment, segmentCount)
+	for index := range segments {
+		segments[index] = VoiceSegment{
+			Data:      make([]byte, 150),
+			Timestamp: float64(index) / 10,
+			Index:     index,
+		}
+	}
+
+	sinks := make(map[string]*memorySink)
+	writer, err := NewPlayerVoiceWriter(Player{ID: "player"}, sampleCodec, true, newMemorySinkOptions(sinks, ModeSplitFull))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, segment := range segments {
+		err = writer.Write(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// every sample placed before the current segment has been written
+		currentPosition := int(segment.Timestamp * 1000)
+		if written := len(sinks["demo_player"].data); written != currentPosition {
+			t.Fatalf("segment %d: %d samples written, want %d", segment.Index, written, currentPosition)
+		}
+	}
+
+	_, err = writer.Close(durationSeconds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// segments are placed one after the other and truncated at the end of the demo
+	expected := make([]int, 0, durationSeconds*1000)
+	for _, segment := range segments {
+		for range len(segment.Data) {
+			expected = append(expected, segment.Index+1)
+		}
+	}
+	expected = expected[:durationSeconds*1000]
+	if !slices.Equal(sinks["demo_player"].data, expected) {
+		t.Fatalf("got %v, want %v", sinks["demo_player"].data, expected)
+	}
+}
+
+func TestPlayerVoiceWriterCreatesFileOfSilentPlayer(t *testing.T) {
+	for _, mode := range []Mode{ModeSplitCompact, ModeSplitFull} {
+		t.Run(string(mode), func(t *testing.T) {
+			sinks := make(map[string]*memorySink)
+			isFullLength := mode == ModeSplitFull
+			writer, err := NewPlayerVoiceWriter(Player{ID: "player"}, sampleCodec, isFullLength, newMemorySinkOptions(sinks, mode))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = writer.Write(VoiceSegment{Timestamp: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = writer.Close(2, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sink := sinks["demo_player"]
+			if sink == nil {
+				t.Fatal("no output created")
+			}
+
+			expectedLength := 0
+			if isFullLength {
+				expectedLength = 2000
+			}
+			if len(sink.data) != expectedLength || slices.ContainsFunc(sink.data, func(sample int) bool { return sample != 0 }) {
+				t.Fatalf("got %d samples, want %d silent samples", len(sink.data), expectedLength)
+			}
+		})
+	}
+}
+
+func TestCanStreamVoices(t *testing.T) {
+	start := TimeBound{Kind: TimeBoundSeconds, Value: 90}
+	tests := []struct {
+		name     string
+		options  ExtractOptions
+		expected bool
+	}{
+		{"split-compact", ExtractOptions{Mode: ModeSplitCompact}, true},
+		{"split-full", ExtractOptions{Mode: ModeSplitFull}, true},
+		{"single-full", ExtractOptions{Mode: ModeSingleFull}, true},
+		{"multitrack", ExtractOptions{Mode: ModeMultitrack}, false},
+		{"split-rounds", ExtractOptions{Mode: ModeSplitRounds}, false},
+		{"clips", ExtractOptions{Mode: ModeClips}, false},
+		{"opus", ExtractOptions{Mode: ModeSplitFull, Format: FormatOpus}, false},
+		{"time range", ExtractOptions{Mode: ModeSplitFull, Start: start}, false},
+		{"skip warmup", ExtractOptions{Mode: ModeSingleFull, SkipWarmup: true}, false},
+		{"collapse pauses", ExtractOptions{Mode: ModeSplitCompact, CollapsePauses: true}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if streamed := test.options.CanStreamVoices(); streamed != test.expected {
+				t.Fatalf("got %t, want %t", streamed, test.expected)
+			}
+		})
+	}
+}
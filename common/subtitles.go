@@ -0,0 +1,87 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type SubtitleCue struct {
+	StartTime float64 // in seconds
+	EndTime   float64 // in seconds
+	Text      string
+}
+
+// BuildSubtitleCues returns 1 cue per utterance labelled with the player's name and timed against the demo clock.
+func BuildSubtitleCues(result *Result, segmentsPerPlayer map[string][]VoiceSegment, options ExtractOptions) []SubtitleCue {
+	names := make(map[string]string, len(result.Players))
+	for _, player := range result.Players {
+		names[player.ID] = player.Name
+	}
+
+	utterances := options.GetUtterances(segmentsPerPlayer)
+	cues := make([]SubtitleCue, 0, len(utterances))
+	for _, utterance := range utterances {
+		endTime := options.Placements.GetUtteranceEndTime(utterance)
+		// an utterance made of a single packet without recorded placement would have no duration
+		if endTime <= utterance.StartTime {
+			endTime = utterance.StartTime + 0.1
+		}
+
+		cues = append(cues, SubtitleCue{
+			StartTime: utterance.StartTime,
+			EndTime:   endTime,
+			Text:      names[utterance.PlayerID],
+		})
+	}
+
+	return cues
+}
+
+// formatSubtitleTime formats seconds as hh:mm:ss<separator>mmm.
+func formatSubtitleTime(seconds float64, separator string) string {
+	milliseconds := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", milliseconds/3600000, milliseconds/60000%60, milliseconds/1000%60, separator, milliseconds%1000)
+}
+
+func FormatSRT(cues []SubtitleCue) string {
+	var builder strings.Builder
+	for index, cue := range cues {
+		fmt.Fprintf(&builder, "%d\n%s --> %s\n%s\n\n", index+1, formatSubtitleTime(cue.StartTime, ","), formatSubtitleTime(cue.EndTime, ","), cue.Text)
+	}
+
+	return builder.String()
+}
+
+func FormatVTT(cues []SubtitleCue) string {
+	var builder strings.Builder
+	builder.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&builder, "%s --> %s\n%s\n\n", formatSubtitleTime(cue.StartTime, "."), formatSubtitleTime(cue.EndTime, "."), cue.Text)
+	}
+
+	return builder.String()
+}
+
+// WriteSubtitles writes <demoName>.srt and <demoName>.vtt in the output folder and returns their paths.
+func WriteSubtitles(result *Result, segmentsPerPlayer map[string][]VoiceSegment, options ExtractOptions) ([]string, error) {
+	cues := BuildSubtitleCues(result, segmentsPerPlayer, options)
+	files := make([]string, 0, 2)
+	for _, subtitles := range []struct {
+		extension string
+		content   string
+	}{
+		{".srt", FormatSRT(cues)},
+		{".vtt", FormatVTT(cues)},
+	} {
+		path := filepath.Join(options.OutputPath, options.DemoName+subtitles.extension)
+		err := os.WriteFile(path, []byte(subtitles.content), 0644)
+		if err != nil {
+			return files, NewWavFileCreationError("Couldn't write subtitles file", err)
+		}
+		files = append(files, path)
+	}
+
+	return files, nil
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
+	demcommon "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/common"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/events"
+)
+
+type TeamKey string
+
+const (
+	TeamKeySide TeamKey = "side" // CT or T at the time the player spoke
+	TeamKeyName TeamKey = "name" // clan name, follows the team across side swaps
+)
+
+var TeamKeys = []TeamKey{TeamKeySide, TeamKeyName}
+
+func (key TeamKey) IsValid() bool {
+	return key == "" || slices.Contains(TeamKeys, key)
+}
+
+// TeamTracker counts side swaps (halftime and overtime) to identify a team when it doesn't have a clan name.
+type TeamTracker struct {
+	parser    dem.Parser
+	swapCount int
+}
+
+func NewTeamTracker(parser dem.Parser) *TeamTracker {
+	tracker := &TeamTracker{
+		parser: parser,
+	}
+
+	parser.RegisterEventHandler(func(events.TeamSideSwitch) {
+		tracker.swapCount++
+	})
+
+	return tracker
+}
+
+// GetPlayerTeam returns the player's current side and team name. The team name is the clan name or the side the team
+// started the match on, i.e. team_CT, when the team doesn't have a clan name.
+func (tracker *TeamTracker) GetPlayerTeam(steamID uint64) (string, string) {
+	player := FindPlayer(tracker.parser, steamID)
+	if player == nil {
+		return "", ""
+	}
+
+	side := getTeamName(player.Team)
+	if side == "" {
+		return "", ""
+	}
+
+	teamState := tracker.parser.GameState().Team(player.Team)
+	if teamState != nil {
+		if clanName := SanitizeFileName(teamState.ClanName()); clanName != "" {
+			return side, clanName
+		}
+	}
+
+	startingTeam := player.Team
+	if tracker.swapCount%2 == 1 {
+		if startingTeam == demcommon.TeamCounterTerrorists {
+			startingTeam = demcommon.TeamTerrorists
+		} else {
+			startingTeam = demcommon.TeamCounterTerrorists
+		}
+	}
+
+	return side, fmt.Sprintf("team_%s", getTeamName(startingTeam))
+}
+
+// GetSegmentsPerTeam groups the segments by side or team name according to options.TeamKey, segments sent while the
+// player wasn't on a team are ignored.
+func (options ExtractOptions) GetSegmentsPerTeam(segmentsPerPlayer map[string][]VoiceSegment) map[string]map[string][]VoiceSegment {
+	segmentsPerTeam := make(map[string]map[string][]VoiceSegment)
+	for playerID, segments := range segmentsPerPlayer {
+		for _, segment := range segments {
+			team := segment.Side
+			if options.TeamKey == TeamKeyName {
+				team = segment.TeamName
+			}
+
+			if team == "" {
+				continue
+			}
+
+			if segmentsPerTeam[team] == nil {
+				segmentsPerTeam[team] = make(map[string][]VoiceSegment)
+			}
+			segmentsPerTeam[team][playerID] = append(segmentsPerTeam[team][playerID], segment)
+		}
+	}
+
+	return segmentsPerTeam
+}
+
+// MergedFileGenerator writes the segments of all players into a single file named after options.DemoName.
+type MergedFileGenerator func(segmentsPerPlayer map[string][]VoiceSegment, options ExtractOptions) ([]string, error)
+
+// GenerateTeamFiles calls the generator for each team with the output name <demoName>_<team>.
+func GenerateTeamFiles(segmentsPerPlayer map[string][]VoiceSegment, options ExtractOptions, generate MergedFileGenerator) ([]string, error) {
+	segmentsPerTeam := options.GetSegmentsPerTeam(segmentsPerPlayer)
+	if len(segmentsPerTeam) == 0 {
+		return nil, NewError(fmt.Sprintf("No team voice data found in demo %s\n", options.DemoPath), nil, NoVoiceDataFound)
+	}
+
+	teams := make([]string, 0, len(segmentsPerTeam))
+	for team := range segmentsPerTeam {
+		teams = append(teams, team)
+	}
+	sort.Strings(teams)
+
+	files := make([]string, 0, len(teams))
+	for _, team := range teams {
+		teamOptions := options
+		teamOptions.DemoName = BuildPlayerOutputName(options.DemoName, team)
+		teamFiles, err := generate(segmentsPerTeam[team], teamOptions)
+		files = append(files, teamFiles...)
+		if err != nil {
+			return files, err
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"math"
+	"slices"
+
+	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/msg"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/msgs2"
+)
+
+type Timebase string
+
+const cs2Filestamp = "PBDEMS2"
+
+const (
+	TimebaseTime Timebase = "time" // demo time computed by the parser
+	TimebaseTick Timebase = "tick" // in-game tick multiplied by the tick interval in float64
+)
+
+var Timebases = []Timebase{TimebaseTime, TimebaseTick}
+
+func (timebase Timebase) IsValid() bool {
+	return timebase == "" || slices.Contains(Timebases, timebase)
+}
+
+// Clock returns the current time of the demo being parsed according to the timebase. All the times of an extraction,
+// voice segments, rounds, events and duration, must come from the same clock to line up.
+type Clock struct {
+	parser     dem.Parser
+	timebase   Timebase
+	serverTick int
+}
+
+// NewClock creates a clock that tracks the server tick of the net_Tick messages, CSGO parsers must be configured to
+// decode them.
+func NewClock(parser dem.Parser, timebase Timebase) *Clock {
+	clock := &Clock{
+		parser:   parser,
+		timebase: timebase,
+	}
+
+	parser.RegisterNetMessageHandler(func(message *msgs2.CNETMsg_Tick) {
+		clock.serverTick = int(message.GetTick())
+	})
+	parser.RegisterNetMessageHandler(func(message *msg.CNETMsg_Tick) {
+		clock.serverTick = int(message.GetTick())
+	})
+
+	return clock
+}
+
+// Tick returns the current in-game tick, the tick of the demo packet being parsed.
+func (clock *Clock) Tick() int {
+	return clock.parser.GameState().IngameTick()
+}
+
+// ServerTick returns the server tick of the last net_Tick message, 0 until the first one has been received. It
+// doesn't start at 0 with the demo, the server was running before the demo has been recorded.
+func (clock *Clock) ServerTick() int {
+	return clock.serverTick
+}
+
+// DemoTickRate returns the number of demo ticks (frames) per second, 0 if unknown. CSGO demos headers contain the
+// playback values before the demo is parsed, CS2 demos contain them only at the end and are recorded at the server
+// tick rate.
+func (clock *Clock) DemoTickRate() float64 {
+	header := clock.parser.Header()
+	if header.Filestamp != cs2Filestamp && header.PlaybackFrames > 0 && header.PlaybackTime > 0 {
+		return float64(header.PlaybackFrames) / header.PlaybackTime.Seconds()
+	}
+
+	return max(0, clock.parser.TickRate())
+}
+
+// DemoTick returns the current demo tick (frame), the tick used by demo_gototick.
+func (clock *Clock) DemoTick() int {
+	return clock.parser.CurrentFrame()
+}
+
+// GetDemoTick returns the demo tick played at the given time, computed from the current time and demo tick.
+func (clock *Clock) GetDemoTick(seconds float64) int {
+	return clock.DemoTick() + int(math.Round((seconds-clock.Seconds())*clock.DemoTickRate()))
+}
+
+// GetTickSeconds returns the time of the tick computed in float64. The parser time is computed in float32
+// nanoseconds, which are rounded to about a quarter of a millisecond after an hour.
+func GetTickSeconds(tick int, tickRate float64) float64 {
+	return float64(tick) / tickRate
+}
+
+// Seconds returns the current time in seconds. With the tick timebase, the time comes from the in-game tick and the
+// tick interval of the server, it falls back to the parser time when the tick rate is unknown.
+func (clock *Clock) Seconds() float64 {
+	tickRate := clock.parser.TickRate()
+	if clock.timebase != TimebaseTick || tickRate <= 0 {
+		return clock.parser.CurrentTime().Seconds()
+	}
+
+	return GetTickSeconds(clock.Tick(), tickRate)
+}
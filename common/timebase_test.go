@@ -0,0 +1,70 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
+)
+
+type fakeGameState struct {
+	dem.GameState
+	ingameTick int
+}
+
+func (gameState fakeGameState) IngameTick() int {
+	return gameState.ingameTick
+}
+
+// fakeParser computes the parser time like demoinfocs, in float32 nanoseconds.
+type fakeParser struct {
+	dem.Parser
+	gameState    fakeGameState
+	tickInterval float32
+}
+
+func (parser *fakeParser) GameState() dem.GameState {
+	return parser.gameState
+}
+
+func (parser *fakeParser) TickRate() float64 {
+	return 1 / float64(parser.tickInterval)
+}
+
+func (parser *fakeParser) CurrentTime() time.Duration {
+	return time.Duration(float32(parser.gameState.ingameTick) * parser.tickInterval * float32(time.Second))
+}
+
+func TestTickTimebasePlacesVoicesAtTheirTick(t *testing.T) {
+	const sampleRate = 48000
+	parser := &fakeParser{tickInterval: 1.0 / 64}
+	timeClock := &Clock{parser: parser, timebase: TimebaseTime}
+	tickClock := &Clock{parser: parser, timebase: TimebaseTick}
+
+	// 750 samples per tick at 64 ticks per second
+	tests := []struct {
+		name                 string
+		ingameTick           int
+		expectedTickPosition int
+		expectedTimePosition int
+	}{
+		{"start of the demo", 0, 0, 0},
+		{"first minute", 3_001, 2_250_750, 2_250_749},
+		{"after 2 hours", 460_801, 345_600_750, 345_600_751},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parser.gameState.ingameTick = test.ingameTick
+			tickPosition := int(tickClock.Seconds() * sampleRate)
+			timePosition := int(timeClock.Seconds() * sampleRate)
+
+			if tickPosition != test.expectedTickPosition {
+				t.Fatalf("tick placement: got sample %d, want %d", tickPosition, test.expectedTickPosition)
+			}
+			if timePosition != test.expectedTimePosition {
+				t.Fatalf("time placement: got sample %d, want %d", timePosition, test.expectedTimePosition)
+			}
+		})
+	}
+}
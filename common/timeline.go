@@ -0,0 +1,365 @@
+package common
+
+import (
+	"cmp"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/events"
+	st "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/sendtables"
+)
+
+// DefaultPauseGapSeconds is the default duration of silence kept in place of a pause where nobody talks.
+const DefaultPauseGapSeconds = 1.0
+
+type PeriodType string
+
+const (
+	PeriodWarmup PeriodType = "warmup"
+	PeriodPause  PeriodType = "pause" // technical pause, tactical timeout or match waiting for resume
+)
+
+// Period is a warmup or pause period of the demo, times are in seconds.
+type Period struct {
+	Type      PeriodType
+	StartTime float64
+	EndTime   float64
+}
+
+// game rules properties that are true while the game is paused
+var pauseProperties = []string{"m_bGamePaused", "m_bMatchWaitingForResume", "m_bTechnicalTimeOut", "m_bTerroristTimeOutActive", "m_bCTTimeOutActive"}
+
+// the game rules properties prefix is different in CS2 and CSGO demos
+var gameRulesPrefixes = []string{"m_pGameRules.", "cs_gamerules_data."}
+
+// PeriodTracker collects the warmup and pause periods while the demo is parsed.
+type PeriodTracker struct {
+	parser  dem.Parser
+	clock   *Clock
+	periods []Period
+	current map[PeriodType]*Period
+}
+
+func NewPeriodTracker(parser dem.Parser, clock *Clock, options ExtractOptions) *PeriodTracker {
+	tracker := &PeriodTracker{
+		parser:  parser,
+		clock:   clock,
+		current: make(map[PeriodType]*Period),
+	}
+
+	if options.SkipWarmup || options.CollapsePauses {
+		parser.RegisterEventHandler(tracker.onFrameDone)
+	}
+
+	return tracker
+}
+
+func isPropertyTrue(entity st.Entity, name string) bool {
+	value, ok := entity.PropertyValue(name)
+	if !ok || (value.S2 && value.Any == nil) {
+		return false
+	}
+
+	return value.BoolVal()
+}
+
+func (tracker *PeriodTracker) isPaused() bool {
+	rules := tracker.parser.GameState().Rules()
+	if rules == nil || rules.Entity() == nil {
+		return false
+	}
+
+	for _, prefix := range gameRulesPrefixes {
+		for _, property := range pauseProperties {
+			if isPropertyTrue(rules.Entity(), prefix+property) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (tracker *PeriodTracker) update(periodType PeriodType, isActive bool) {
+	current := tracker.current[periodType]
+	if isActive && current == nil {
+		tracker.current[periodType] = &Period{
+			Type:      periodType,
+			StartTime: tracker.clock.Seconds(),
+		}
+	} else if !isActive && current != nil {
+		current.EndTime = tracker.clock.Seconds()
+		tracker.periods = append(tracker.periods, *current)
+		delete(tracker.current, periodType)
+	}
+}
+
+func (tracker *PeriodTracker) onFrameDone(events.FrameDone) {
+	tracker.update(PeriodWarmup, tracker.parser.GameState().IsWarmupPeriod())
+	tracker.update(PeriodPause, tracker.isPaused())
+}
+
+// Periods returns the periods found, a period still active at the end of the demo ends at the given duration.
+func (tracker *PeriodTracker) Periods(durationSeconds float64) []Period {
+	periods := slices.Clone(tracker.periods)
+	for _, current := range tracker.current {
+		period := *current
+		period.EndTime = durationSeconds
+		periods = append(periods, period)
+	}
+
+	slices.SortFunc(periods, func(a, b Period) int {
+		return cmp.Compare(a.StartTime, b.StartTime)
+	})
+
+	return periods
+}
+
+// TimelineRange is a part of the demo kept in the outputs.
+type TimelineRange struct {
+	OutputTime float64 `json:"outputTime"` // start in the outputs, in seconds
+	DemoTime   float64 `json:"demoTime"`   // start in the demo, in seconds
+	Duration   float64 `json:"duration"`   // in seconds
+	StartTick  int     `json:"startTick"`  // demo tick
+	EndTick    int     `json:"endTick"`    // demo tick
+}
+
+// Timeline maps the times of the outputs, without warmup and with collapsed pauses, to the demo.
+type Timeline struct {
+	Demo            string          `json:"demo"`
+	DurationSeconds float64         `json:"durationSeconds"` // duration of the outputs
+	TickRate        float64         `json:"tickRate"`        // demo ticks per second
+	Ranges          []TimelineRange `json:"ranges"`
+	windowStartTime float64         // the times of the outputs are relative to the window start before mapping
+}
+
+type timeSpan struct {
+	start float64
+	end   float64
+}
+
+// getPauseCuts returns the parts of the pause to remove so that every silence lasts gapSeconds at most. voiceTimes
+// must be sorted.
+func getPauseCuts(pause timeSpan, voiceTimes []float64, gapSeconds float64) []timeSpan {
+	cuts := make([]timeSpan, 0)
+	// the pause start and the voice segments sent during the pause
+	activityTimes := []float64{pause.start}
+	firstIndex := sort.SearchFloat64s(voiceTimes, pause.start)
+	for _, voiceTime := range voiceTimes[firstIndex:] {
+		if voiceTime >= pause.end {
+			break
+		}
+		activityTimes = append(activityTimes, voiceTime)
+	}
+	activityTimes = append(activityTimes, pause.end)
+
+	for index := 0; index < len(activityTimes)-1; index++ {
+		silenceStart := activityTimes[index] + gapSeconds
+		silenceEnd := activityTimes[index+1]
+		if silenceEnd > silenceStart {
+			cuts = append(cuts, timeSpan{silenceStart, silenceEnd})
+		}
+	}
+
+	return cuts
+}
+
+// BuildTimeline returns the timeline of the outputs without the warmup periods when options.SkipWarmup is true and
+// with the silences during pauses shortened to options.PauseGapSeconds when options.CollapsePauses is true. Segments
+// and periods times are relative to the window start, the timeline is nil when both options are disabled.
+func BuildTimeline(periods []Period, segmentsPerPlayer map[string][]VoiceSegment, durationSeconds float64, window *TimeWindow, clock *Clock, options ExtractOptions) *Timeline {
+	if !options.SkipWarmup && !options.CollapsePauses {
+		return nil
+	}
+
+	voiceTimes := make([]float64, 0)
+	for _, segments := range segmentsPerPlayer {
+		for _, segment := range segments {
+			voiceTimes = append(voiceTimes, segment.Timestamp)
+		}
+	}
+	slices.Sort(voiceTimes)
+
+	cuts := make([]timeSpan, 0)
+	for _, period := range periods {
+		span := timeSpan{
+			start: max(0, period.StartTime-window.GetStartTime()),
+			end:   min(durationSeconds, period.EndTime-window.GetStartTime()),
+		}
+		if span.end <= span.start {
+			continue
+		}
+
+		if period.Type == PeriodWarmup && options.SkipWarmup {
+			cuts = append(cuts, span)
+		} else if period.Type == PeriodPause && options.CollapsePauses {
+			cuts = append(cuts, getPauseCuts(span, voiceTimes, options.PauseGapSeconds)...)
+		}
+	}
+	slices.SortFunc(cuts, func(a, b timeSpan) int {
+		return cmp.Compare(a.start, b.start)
+	})
+
+	timeline := &Timeline{
+		Demo:            options.DemoName,
+		TickRate:        clock.DemoTickRate(),
+		Ranges:          make([]TimelineRange, 0, len(cuts)+1),
+		windowStartTime: window.GetStartTime(),
+	}
+	addRange := func(start float64, end float64) {
+		if end <= start {
+			return
+		}
+
+		demoTime := start + window.GetStartTime()
+		timeline.Ranges = append(timeline.Ranges, TimelineRange{
+			OutputTime: timeline.DurationSeconds,
+			DemoTime:   demoTime,
+			Duration:   end - start,
+			StartTick:  clock.GetDemoTick(demoTime),
+			EndTick:    clock.GetDemoTick(demoTime + end - start),
+		})
+		timeline.DurationSeconds += end - start
+	}
+
+	// cuts may overlap, i.e. a pause during the warmup
+	keptStart := 0.0
+	for _, cut := range cuts {
+		addRange(keptStart, cut.start)
+		keptStart = max(keptStart, cut.end)
+	}
+	addRange(keptStart, durationSeconds)
+
+	return timeline
+}
+
+// MapTime returns the output time of a time relative to the window start and whether it has been kept. A removed
+// time is mapped to the output time where it has been removed.
+func (timeline *Timeline) MapTime(time float64) (float64, bool) {
+	if timeline == nil {
+		return time, true
+	}
+
+	demoTime := time + timeline.windowStartTime
+	for _, timelineRange := range timeline.Ranges {
+		if demoTime < timelineRange.DemoTime {
+			return timelineRange.OutputTime, false
+		}
+		if demoTime < timelineRange.DemoTime+timelineRange.Duration {
+			return timelineRange.OutputTime + demoTime - timelineRange.DemoTime, true
+		}
+	}
+
+	return timeline.DurationSeconds, false
+}
+
+// GetDemoTime returns the time in the demo of an output time.
+func (timeline *Timeline) GetDemoTime(outputTime float64) float64 {
+	if len(timeline.Ranges) == 0 {
+		return outputTime + timeline.windowStartTime
+	}
+
+	for _, timelineRange := range timeline.Ranges {
+		if outputTime < timelineRange.OutputTime+timelineRange.Duration {
+			return timelineRange.DemoTime + max(0, outputTime-timelineRange.OutputTime)
+		}
+	}
+
+	last := timeline.Ranges[len(timeline.Ranges)-1]
+	return last.DemoTime + last.Duration
+}
+
+// GetDemoTime returns the time in the demo of a time in the outputs.
+func (result *Result) GetDemoTime(outputTime float64) float64 {
+	if result.Timeline != nil {
+		return result.Timeline.GetDemoTime(outputTime)
+	}
+
+	return outputTime + result.Window.GetStartTime()
+}
+
+// GetDuration returns the duration of the outputs, the given duration for a nil timeline.
+func (timeline *Timeline) GetDuration(durationSeconds float64) float64 {
+	if timeline == nil {
+		return durationSeconds
+	}
+
+	return timeline.DurationSeconds
+}
+
+// MapSegments returns the segments that have been kept with their output timestamps and the players that still have
+// segments.
+func (timeline *Timeline) MapSegments(segmentsPerPlayer map[string][]VoiceSegment, players map[string]Player) (map[string][]VoiceSegment, map[string]Player) {
+	if timeline == nil {
+		return segmentsPerPlayer, players
+	}
+
+	mappedSegments := make(map[string][]VoiceSegment)
+	mappedPlayers := make(map[string]Player)
+	for playerID, segments := range segmentsPerPlayer {
+		for _, segment := range segments {
+			timestamp, isKept := timeline.MapTime(segment.Timestamp)
+			if !isKept {
+				continue
+			}
+
+			segment.Timestamp = timestamp
+			mappedSegments[playerID] = append(mappedSegments[playerID], segment)
+		}
+
+		if len(mappedSegments[playerID]) > 0 {
+			mappedPlayers[playerID] = players[playerID]
+		}
+	}
+
+	return mappedSegments, mappedPlayers
+}
+
+// MapRounds returns the rounds with their output times, rounds that have been entirely removed are dropped.
+func (timeline *Timeline) MapRounds(rounds []Round) []Round {
+	if timeline == nil {
+		return rounds
+	}
+
+	mappedRounds := make([]Round, 0, len(rounds))
+	for _, round := range rounds {
+		round.StartTime, _ = timeline.MapTime(round.StartTime)
+		round.EndTime, _ = timeline.MapTime(round.EndTime)
+		if round.FreezetimeEndTime != 0 {
+			round.FreezetimeEndTime, _ = timeline.MapTime(round.FreezetimeEndTime)
+		}
+		if round.EndTime > round.StartTime {
+			mappedRounds = append(mappedRounds, round)
+		}
+	}
+
+	return mappedRounds
+}
+
+// MapEvents returns the events with their output times, DemoTime is kept.
+func (timeline *Timeline) MapEvents(events []GameEvent) []GameEvent {
+	if timeline == nil {
+		return events
+	}
+
+	mappedEvents := make([]GameEvent, 0, len(events))
+	for _, event := range events {
+		event.Time, _ = timeline.MapTime(event.Time)
+		mappedEvents = append(mappedEvents, event)
+	}
+
+	return mappedEvents
+}
+
+// WriteTimeline writes <demoName>.timeline.json in the output folder and returns its path.
+func WriteTimeline(timeline *Timeline, options ExtractOptions) (string, error) {
+	path := filepath.Join(options.OutputPath, options.DemoName+".timeline.json")
+	err := WriteJSONFile(path, timeline)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGetPauseCuts(t *testing.T) {
+	pause := timeSpan{10, 30}
+	voiceTimes := []float64{5, 12, 20.5, 35}
+	tests := []struct {
+		name       string
+		gapSeconds float64
+		expected   []timeSpan
+	}{
+		{"default gap", DefaultPauseGapSeconds, []timeSpan{{11, 12}, {13, 20.5}, {21.5, 30}}},
+		{"no gap", 0, []timeSpan{{10, 12}, {12, 20.5}, {20.5, 30}}},
+		{"gap longer than the pause", 30, []timeSpan{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cuts := getPauseCuts(pause, voiceTimes, test.gapSeconds)
+			if !slices.Equal(cuts, test.expected) {
+				t.Fatalf("got %v, want %v", cuts, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/events"
+)
+
+type TimeBoundKind string
+
+const (
+	TimeBoundNone    TimeBoundKind = ""
+	TimeBoundSeconds TimeBoundKind = "seconds" // i.e. 90 or 90s
+	TimeBoundTick    TimeBoundKind = "tick"    // demo tick, i.e. tick:12800
+	TimeBoundRound   TimeBoundKind = "round"   // i.e. round:5, the round start for a start bound and its end otherwise
+)
+
+// TimeBound is the start or the end of the part of the demo to extract.
+type TimeBound struct {
+	Kind  TimeBoundKind
+	Value float64
+}
+
+func (bound TimeBound) IsSet() bool {
+	return bound.Kind != TimeBoundNone
+}
+
+func (bound TimeBound) String() string {
+	switch bound.Kind {
+	case TimeBoundSeconds:
+		return fmt.Sprintf("%gs", bound.Value)
+	case TimeBoundTick, TimeBoundRound:
+		return fmt.Sprintf("%s:%d", bound.Kind, int(bound.Value))
+	default:
+		return ""
+	}
+}
+
+// ParseTimeBound parses seconds (90 or 90s), a tick (tick:12800) or a round number (round:5).
+func ParseTimeBound(value string) (TimeBound, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return TimeBound{}, nil
+	}
+
+	for _, kind := range []TimeBoundKind{TimeBoundTick, TimeBoundRound} {
+		number, found := strings.CutPrefix(value, string(kind)+":")
+		if !found {
+			continue
+		}
+
+		parsedNumber, err := strconv.Atoi(number)
+		if err != nil || parsedNumber < 0 || (kind == TimeBoundRound && parsedNumber == 0) {
+			return TimeBound{}, NewInvalidArgumentError(fmt.Sprintf("Invalid %s number: %s", kind, number), err)
+		}
+
+		return TimeBound{Kind: kind, Value: float64(parsedNumber)}, nil
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSuffix(value, "s"), 64)
+	if err != nil || seconds < 0 {
+		return TimeBound{}, NewInvalidArgumentError(fmt.Sprintf("Invalid time, it must be seconds, tick:<number> or round:<number>: %s", value), err)
+	}
+
+	return TimeBound{Kind: TimeBoundSeconds, Value: seconds}, nil
+}
+
+// ValidateTimeBounds returns an error when options.Start is not before options.End.
+func (options ExtractOptions) ValidateTimeBounds() error {
+	start, end := options.Start, options.End
+	if !start.IsSet() || !end.IsSet() || start.Kind != end.Kind {
+		return nil
+	}
+
+	// round:N to round:N is the round N
+	if start.Value > end.Value || (start.Kind != TimeBoundRound && start.Value == end.Value) {
+		return NewInvalidArgumentError(fmt.Sprintf("The start %s must be before the end %s", start, end), nil)
+	}
+
+	return nil
+}
+
+// TimeWindow is the part of the demo extracted, times are in seconds from the start of the demo.
+type TimeWindow struct {
+	StartTime float64 `json:"startTime"`
+	EndTime   float64 `json:"endTime"`
+	StartTick int     `json:"startTick"` // demo tick
+	EndTick   int     `json:"endTick"`   // demo tick
+}
+
+// TimeWindowTracker finds when options.Start and options.End are reached while the demo is parsed and cancels the
+// parsing once the end is reached.
+type TimeWindowTracker struct {
+	parser       dem.Parser
+	clock        *Clock
+	roundTracker *RoundTracker
+	start        TimeBound
+	end          TimeBound
+	window       TimeWindow
+	hasStarted   bool
+	hasEnded     bool
+}
+
+func NewTimeWindowTracker(parser dem.Parser, clock *Clock, roundTracker *RoundTracker, options ExtractOptions) *TimeWindowTracker {
+	tracker := &TimeWindowTracker{
+		parser:       parser,
+		clock:        clock,
+		roundTracker: roundTracker,
+		start:        options.Start,
+		end:          options.End,
+		hasStarted:   !options.Start.IsSet(),
+	}
+
+	if options.Start.IsSet() || options.End.IsSet() {
+		parser.RegisterEventHandler(tracker.onFrameDone)
+	}
+
+	return tracker
+}
+
+// isRoundStarted returns true when the round number has started or a later round has been played.
+func (tracker *TimeWindowTracker) isRoundStarted(number int) bool {
+	current := tracker.roundTracker.current
+	rounds := tracker.roundTracker.rounds
+
+	return (current != nil && current.Number >= number) || (len(rounds) > 0 && rounds[len(rounds)-1].Number >= number)
+}
+
+// isRoundEnded returns true when the round number has ended or a later round has started.
+func (tracker *TimeWindowTracker) isRoundEnded(number int) bool {
+	current := tracker.roundTracker.current
+	rounds := tracker.roundTracker.rounds
+
+	return (current != nil && current.Number > number) || (len(rounds) > 0 && rounds[len(rounds)-1].Number >= number)
+}
+
+func (tracker *TimeWindowTracker) isReached(bound TimeBound, isEnd bool) bool {
+	switch bound.Kind {
+	case TimeBoundSeconds:
+		return tracker.clock.Seconds() >= bound.Value
+	case TimeBoundTick:
+		return tracker.clock.DemoTick() >= int(bound.Value)
+	case TimeBoundRound:
+		if isEnd {
+			return tracker.isRoundEnded(int(bound.Value))
+		}
+		return tracker.isRoundStarted(int(bound.Value))
+	default:
+		return false
+	}
+}
+
+// getBoundTime returns the exact time for seconds bounds and the current time otherwise.
+func (tracker *TimeWindowTracker) getBoundTime(bound TimeBound) float64 {
+	if bound.Kind == TimeBoundSeconds {
+		return bound.Value
+	}
+
+	return tracker.clock.Seconds()
+}
+
+func (tracker *TimeWindowTracker) onFrameDone(events.FrameDone) {
+	if !tracker.hasStarted && tracker.isReached(tracker.start, false) {
+		tracker.hasStarted = true
+		tracker.window.StartTime = tracker.getBoundTime(tracker.start)
+		tracker.window.StartTick = tracker.clock.DemoTick()
+	}
+
+	if tracker.hasStarted && !tracker.hasEnded && tracker.isReached(tracker.end, true) {
+		tracker.hasEnded = true
+		tracker.window.EndTime = max(tracker.window.StartTime, tracker.getBoundTime(tracker.end))
+		tracker.window.EndTick = tracker.clock.DemoTick()
+		// nothing to extract after the end
+		tracker.parser.Cancel()
+	}
+}
+
+// HasEnded returns true when the parsing has been canceled because the end has been reached.
+func (tracker *TimeWindowTracker) HasEnded() bool {
+	return tracker.hasEnded
+}
+
+// Window returns the part of the demo to extract, nil when neither options.Start nor options.End is set. The window
+// ends at the given demo duration if the end hasn't been reached.
+func (tracker *TimeWindowTracker) Window(durationSeconds float64) (*TimeWindow, error) {
+	if !tracker.start.IsSet() && !tracker.end.IsSet() {
+		return nil, nil
+	}
+
+	if !tracker.hasStarted {
+		return nil, NewInvalidArgumentError(fmt.Sprintf("The start %s is after the end of the demo", tracker.start), nil)
+	}
+
+	window := tracker.window
+	if !tracker.hasEnded {
+		window.EndTime = durationSeconds
+		window.EndTick = tracker.clock.DemoTick()
+	}
+
+	return &window, nil
+}
+
+// GetStartTime returns the start of the window in the demo, 0 for a nil window.
+func (window *TimeWindow) GetStartTime() float64 {
+	if window == nil {
+		return 0
+	}
+
+	return window.StartTime
+}
+
+// GetDuration returns the duration of the window, the demo duration for a nil window.
+func (window *TimeWindow) GetDuration(durationSeconds float64) float64 {
+	if window == nil {
+		return durationSeconds
+	}
+
+	return window.EndTime - window.StartTime
+}
+
+// SliceSegments returns the segments sent during the window with timestamps relative to its start and the players
+// that have segments in it.
+func (window *TimeWindow) SliceSegments(segmentsPerPlayer map[string][]VoiceSegment, players map[string]Player) (map[string][]VoiceSegment, map[string]Player) {
+	if window == nil {
+		return segmentsPerPlayer, players
+	}
+
+	slicedSegments := SliceSegments(segmentsPerPlayer, window.StartTime, window.EndTime)
+	slicedPlayers := make(map[string]Player, len(slicedSegments))
+	for playerID := range slicedSegments {
+		slicedPlayers[playerID] = players[playerID]
+	}
+
+	return slicedSegments, slicedPlayers
+}
+
+// SliceRounds returns the rounds that overlap with the window, cut to the window and relative to its start.
+func (window *TimeWindow) SliceRounds(rounds []Round) []Round {
+	if window == nil {
+		return rounds
+	}
+
+	slicedRounds := make([]Round, 0, len(rounds))
+	for _, round := range rounds {
+		if round.EndTime <= window.StartTime || round.StartTime >= window.EndTime {
+			continue
+		}
+
+		round.StartTime = max(round.StartTime, window.StartTime) - window.StartTime
+		round.EndTime = min(round.EndTime, window.EndTime) - window.StartTime
+		if round.FreezetimeEndTime != 0 {
+			round.FreezetimeEndTime = max(0, min(round.FreezetimeEndTime-window.StartTime, round.EndTime))
+		}
+		slicedRounds = append(slicedRounds, round)
+	}
+
+	return slicedRounds
+}
+
+// SliceEvents returns the events that happened during the window with times relative to its start, DemoTime is kept.
+func (window *TimeWindow) SliceEvents(events []GameEvent) []GameEvent {
+	if window == nil {
+		return events
+	}
+
+	slicedEvents := make([]GameEvent, 0, len(events))
+	for _, event := range events {
+		if event.Time < window.StartTime || event.Time > window.EndTime {
+			continue
+		}
+
+		event.Time -= window.StartTime
+		slicedEvents = append(slicedEvents, event)
+	}
+
+	return slicedEvents
+}
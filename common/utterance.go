@@ -0,0 +1,87 @@
+package common
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DefaultClipGapSeconds is the default maximum gap between 2 voice segments of the same utterance.
+const DefaultClipGapSeconds = 0.5
+
+// Utterance is a group of consecutive voice segments of a player, such as a callout.
+type Utterance struct {
+	PlayerID  string
+	StartTick int     // demo tick
+	StartTime float64 // in seconds
+	EndTime   float64 // timestamp of the last segment in seconds
+	IsAlive   bool    // whether the speaker was alive at the start of the utterance
+	Segments  []VoiceSegment
+}
+
+// GroupUtterances splits the segments into utterances when the gap between 2 segments timestamps is greater than or
+// equal to gapSeconds.
+func GroupUtterances(playerID string, segments []VoiceSegment, gapSeconds float64) []Utterance {
+	utterances := make([]Utterance, 0)
+	for _, segment := range segments {
+		if len(utterances) > 0 {
+			utterance := &utterances[len(utterances)-1]
+			if segment.Timestamp-utterance.EndTime < gapSeconds {
+				utterance.Segments = append(utterance.Segments, segment)
+				utterance.EndTime = segment.Timestamp
+				continue
+			}
+		}
+
+		utterances = append(utterances, Utterance{
+			PlayerID:  playerID,
+			StartTick: segment.DemoTick,
+			StartTime: segment.Timestamp,
+			EndTime:   segment.Timestamp,
+			IsAlive:   segment.IsAlive,
+			Segments:  []VoiceSegment{segment},
+		})
+	}
+
+	return utterances
+}
+
+// GetUtterances returns the utterances of all players sorted by start time then player ID.
+func (options ExtractOptions) GetUtterances(segmentsPerPlayer map[string][]VoiceSegment) []Utterance {
+	gapSeconds := options.ClipGapSeconds
+	if gapSeconds <= 0 {
+		gapSeconds = DefaultClipGapSeconds
+	}
+
+	utterances := make([]Utterance, 0)
+	for playerID, segments := range segmentsPerPlayer {
+		utterances = append(utterances, GroupUtterances(playerID, segments, gapSeconds)...)
+	}
+
+	slices.SortFunc(utterances, func(a, b Utterance) int {
+		if a.StartTime != b.StartTime {
+			if a.StartTime < b.StartTime {
+				return -1
+			}
+			return 1
+		}
+
+		return strings.Compare(a.PlayerID, b.PlayerID)
+	})
+
+	return utterances
+}
+
+// BuildClipOutputName returns the name of an utterance file, i.e. demoName_playerID_tick1234_56.789s.
+func BuildClipOutputName(demoName string, utterance Utterance) string {
+	return fmt.Sprintf("%s_%s_tick%d_%.3fs", demoName, utterance.PlayerID, utterance.StartTick, utterance.StartTime)
+}
+
+func (options ExtractOptions) CreateClipSink(player Player, utterance Utterance, format AudioFormat) (AudioSink, error) {
+	return options.CreateSink(AudioSinkInfo{
+		Kind:   SinkKindClip,
+		Name:   BuildClipOutputName(options.DemoName, utterance),
+		Player: &player,
+		Format: format,
+	})
+}
@@ -0,0 +1,192 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	waveFormatExtensible = 0xFFFE
+	// offsets of the size fields patched on Close
+	wavRiffSizeOffset = 4
+	wavDataSizeOffset = 64
+	wavHeaderSize     = 68
+)
+
+// KSDATAFORMAT_SUBTYPE_PCM, the sub format GUID of WAVE_FORMAT_EXTENSIBLE PCM files.
+var wavSubFormatPCM = [16]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71}
+
+// ExtensibleWavSink writes a WAVE_FORMAT_EXTENSIBLE file, required to store more than 2 channels. The channel mask is
+// 0, channels are not assigned to speakers so audio editors open each channel as a separate track.
+type ExtensibleWavSink struct {
+	writer          io.WriteSeeker
+	buffer          *bufio.Writer
+	format          AudioFormat
+	bytesPerSample  int
+	dataSize        int64
+	writtenPosition int
+}
+
+func NewExtensibleWavSink(writer io.WriteSeeker, format AudioFormat) (*ExtensibleWavSink, error) {
+	if format.BitDepth%8 != 0 || format.BitDepth < 8 || format.BitDepth > 32 {
+		return nil, NewWavFileCreationError(fmt.Sprintf("Unsupported WAV bit depth: %d", format.BitDepth), nil)
+	}
+
+	sink := &ExtensibleWavSink{
+		writer:         writer,
+		buffer:         bufio.NewWriterSize(writer, 64*1024),
+		format:         format,
+		bytesPerSample: format.BitDepth / 8,
+	}
+
+	err := sink.writeHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (sink *ExtensibleWavSink) writeHeader() error {
+	blockAlign := sink.format.NumChannels * sink.bytesPerSample
+	header := make([]byte, 0, wavHeaderSize)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, 0) // patched on Close
+	header = append(header, "WAVE"...)
+
+	header = append(header, "fmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 40)
+	header = binary.LittleEndian.AppendUint16(header, waveFormatExtensible)
+	header = binary.LittleEndian.AppendUint16(header, uint16(sink.format.NumChannels))
+	header = binary.LittleEndian.AppendUint32(header, uint32(sink.format.SampleRate))
+	header = binary.LittleEndian.AppendUint32(header, uint32(sink.format.SampleRate*blockAlign))
+	header = binary.LittleEndian.AppendUint16(header, uint16(blockAlign))
+	header = binary.LittleEndian.AppendUint16(header, uint16(sink.format.BitDepth))
+	header = binary.LittleEndian.AppendUint16(header, 22) // size of the extension
+	header = binary.LittleEndian.AppendUint16(header, uint16(sink.format.BitDepth))
+	header = binary.LittleEndian.AppendUint32(header, 0) // channel mask
+	header = append(header, wavSubFormatPCM[:]...)
+
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, 0) // patched on Close
+
+	_, err := sink.buffer.Write(header)
+	if err != nil {
+		return NewWavFileCreationError("Couldn't write WAV file", err)
+	}
+
+	return nil
+}
+
+func (sink *ExtensibleWavSink) Write(frame AudioFrame) error {
+	// fill the gap with silence
+	if frame.Position > sink.writtenPosition {
+		err := WriteSilence(sink, sink.format, sink.writtenPosition, frame.Position)
+		if err != nil {
+			return err
+		}
+	}
+
+	size := int64(len(frame.Data) * sink.bytesPerSample)
+	if wavHeaderSize-8+sink.dataSize+size > math.MaxUint32 {
+		return NewWavFileCreationError("WAV files can't exceed 4 GB, try the flac format or fewer players", nil)
+	}
+
+	var sample [4]byte
+	for _, value := range frame.Data {
+		binary.LittleEndian.PutUint32(sample[:], uint32(value))
+		if sink.bytesPerSample == 1 {
+			sample[0] += 0x80 // 8-bit WAV samples are unsigned
+		}
+
+		_, err := sink.buffer.Write(sample[:sink.bytesPerSample])
+		if err != nil {
+			return NewWavFileCreationError("Couldn't write WAV file", err)
+		}
+	}
+
+	sink.dataSize += size
+	sink.writtenPosition += len(frame.Data) / sink.format.NumChannels
+
+	return nil
+}
+
+// Close writes the final chunk sizes, it doesn't close the underlying writer.
+func (sink *ExtensibleWavSink) Close() error {
+	// chunks must have an even size
+	if sink.dataSize%2 == 1 {
+		err := sink.buffer.WriteByte(0)
+		if err != nil {
+			return NewWavFileCreationError("Couldn't write WAV file", err)
+		}
+	}
+
+	err := sink.buffer.Flush()
+	if err != nil {
+		return NewWavFileCreationError("Couldn't write WAV file", err)
+	}
+
+	riffSize := wavHeaderSize - 8 + sink.dataSize + sink.dataSize%2
+	for _, field := range []struct {
+		offset int64
+		value  uint32
+	}{
+		{wavRiffSizeOffset, uint32(riffSize)},
+		{wavDataSizeOffset, uint32(sink.dataSize)},
+	} {
+		_, err = sink.writer.Seek(field.offset, io.SeekStart)
+		if err == nil {
+			err = binary.Write(sink.writer, binary.LittleEndian, field.value)
+		}
+		if err != nil {
+			return NewWavFileCreationError("Couldn't write WAV header", err)
+		}
+	}
+
+	return nil
+}
+
+type ExtensibleWavFileSink struct {
+	*ExtensibleWavSink
+	file *os.File
+}
+
+func NewExtensibleWavFileSink(path string, format AudioFormat) (*ExtensibleWavFileSink, error) {
+	file, err := CreateWavFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sink, err := NewExtensibleWavSink(file, format)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &ExtensibleWavFileSink{
+		ExtensibleWavSink: sink,
+		file:              file,
+	}, nil
+}
+
+func (sink *ExtensibleWavFileSink) Path() string {
+	return sink.file.Name()
+}
+
+func (sink *ExtensibleWavFileSink) Close() error {
+	err := sink.ExtensibleWavSink.Close()
+	closeErr := sink.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if closeErr != nil {
+		return NewWavFileCreationError("Couldn't close WAV file", closeErr)
+	}
+
+	return nil
+}
@@ -21,12 +21,7 @@ func NewSteamDecoder(sampleRate int, channels int) (*SteamDecoder, error) {
 	decoder, err := opus.NewDecoder(sampleRate, channels)
 
 	if err != nil {
-		common.HandleError(common.Error{
-			Message:  "Failed to create Steam decoder",
-			Err:      err,
-			ExitCode: common.DecodingError,
-		})
-		return nil, err
+		return nil, common.NewDecodingError("Failed to create Steam decoder", err)
 	}
 
 	return &SteamDecoder{
@@ -127,14 +122,10 @@ func (d *SteamDecoder) decodeLoss(samples uint16) ([]float32, error) {
 func NewOpusDecoder(sampleRate int, channels int) (decoder *opus.Decoder, err error) {
 	decoder, err = opus.NewDecoder(sampleRate, channels)
 	if err != nil {
-		common.HandleError(common.Error{
-			Message:  "Failed to create Opus decoder",
-			Err:      err,
-			ExitCode: common.DecodingError,
-		})
+		return nil, common.NewDecodingError("Failed to create Opus decoder", err)
 	}
 
-	return decoder, err
+	return decoder, nil
 }
 
 func Decode(decoder *opus.Decoder, data []byte) (pcm []float32, err error) {
@@ -147,3 +138,42 @@ func Decode(decoder *opus.Decoder, data []byte) (pcm []float32, err error) {
 
 	return pcm[:writtenLength], nil
 }
+
+// maxConcealedPackets limits the audio generated for long gaps, like decodeLoss does for Steam Voice.
+const maxConcealedPackets = 10
+
+// ConcealLoss returns the samples that replace the packets lost before data. With ConcealmentFEC, the last lost packet
+// is recovered from the forward error correction data of data, other lost packets are predicted by the decoder.
+func ConcealLoss(decoder *opus.Decoder, data []byte, lostPackets int, concealment common.PacketLossConcealment) ([]float32, error) {
+	if !concealment.IsEnabled() || lostPackets <= 0 {
+		return nil, nil
+	}
+
+	// lost packets are assumed to last as long as the last decoded one
+	frameSize, err := decoder.LastPacketDuration()
+	if err != nil {
+		return nil, common.NewDecodingError("Failed to get the Opus packet duration", err)
+	}
+	if frameSize <= 0 {
+		return nil, nil
+	}
+
+	lostPackets = min(lostPackets, maxConcealedPackets)
+	output := make([]float32, 0, frameSize*lostPackets)
+	for index := range lostPackets {
+		pcm := make([]float32, frameSize)
+		// the FEC data of a packet describes the packet right before it
+		if concealment == common.ConcealmentFEC && index == lostPackets-1 {
+			err = decoder.DecodeFECFloat32(data, pcm)
+		} else {
+			err = decoder.DecodePLCFloat32(pcm)
+		}
+		if err != nil {
+			return nil, common.NewDecodingError("Failed to conceal lost Opus packets", err)
+		}
+
+		output = append(output, pcm...)
+	}
+
+	return output, nil
+}
@@ -1,20 +1,21 @@
 package cs2
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
 	"slices"
-	"strings"
 
 	"github.com/akiver/csgo-voice-extractor/common"
-	"github.com/go-audio/audio"
-	"github.com/go-audio/wav"
 	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/events"
 	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/msgs2"
-	"gopkg.in/hraban/opus.v2"
 )
 
 const (
@@ -24,12 +25,6 @@ const (
 	steamSampleRate = 24000
 )
 
-func buildPlayerWavFileName(outputPath string, demoName string, playerID string) string {
-	fileName := fmt.Sprintf("%s_%s.wav", demoName, playerID)
-
-	return filepath.Join(outputPath, fileName)
-}
-
 func getFormatSampleRate(format msgs2.VoiceDataFormatT) int {
 	if format == msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_OPUS {
 		return opusSampleRate
@@ -38,6 +33,14 @@ func getFormatSampleRate(format msgs2.VoiceDataFormatT) int {
 	return steamSampleRate
 }
 
+func getAudioFormat(format msgs2.VoiceDataFormatT) common.AudioFormat {
+	return common.AudioFormat{
+		SampleRate:  getFormatSampleRate(format),
+		NumChannels: 1,
+		BitDepth:    32,
+	}
+}
+
 func samplesToInt32(samples []float32) []int {
 	ints := make([]int, len(samples))
 	for i, v := range samples {
@@ -47,355 +50,389 @@ func samplesToInt32(samples []float32) []int {
 	return ints
 }
 
-func writeAudioToWav(enc *wav.Encoder, sampleRate int, data []int) error {
-	buf := &audio.IntBuffer{
-		Data: data,
-		Format: &audio.Format{
-			SampleRate:  sampleRate,
-			NumChannels: 1,
-		},
+// newSpeakerDecoder returns the decoder of a single speaker, the Opus decoder and the Steam Voice frame counter keep
+// state from a packet to the next one.
+func newSpeakerDecoder(format msgs2.VoiceDataFormatT, concealment common.PacketLossConcealment) (common.SegmentDecoder, error) {
+	sampleRate := getFormatSampleRate(format)
+	if format == msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_OPUS {
+		decoder, err := NewOpusDecoder(sampleRate, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(segment common.VoiceSegment) ([]float32, error) {
+			concealed, err := ConcealLoss(decoder, segment.Data, segment.LostPackets, concealment)
+			if err != nil {
+				return nil, err
+			}
+
+			pcm, err := Decode(decoder, segment.Data)
+			if err != nil {
+				return nil, err
+			}
+
+			return append(concealed, pcm...), nil
+		}, nil
 	}
-	if err := enc.Write(buf); err != nil {
-		common.HandleError(common.Error{
-			Message:  "Couldn't write WAV file",
-			Err:      err,
-			ExitCode: common.WavFileCreationError,
-		})
+
+	decoder, err := NewSteamDecoder(sampleRate, 1)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return func(segment common.VoiceSegment) ([]float32, error) {
+		chunk, err := DecodeChunk(segment.Data)
+		if err != nil || chunk == nil || len(chunk.Data) == 0 {
+			return nil, nil
+		}
+
+		return decoder.Decode(chunk.Data)
+	}, nil
 }
 
-func writePCMToWav(pcmBuffer []int, sampleRate int, filePath string) {
-	outFile, err := os.Create(filePath)
-	if err != nil {
-		common.HandleError(common.Error{
-			Message:  "Couldn't write WAV file",
-			Err:      err,
-			ExitCode: common.WavFileCreationError,
-		})
-		return
-	}
-	defer outFile.Close()
+// newSegmentDecoder returns a decoder that decodes the segments of each SteamID with its own speaker decoder, so that
+// segments of several players can be decoded in any order.
+func newSegmentDecoder(format msgs2.VoiceDataFormatT, concealment common.PacketLossConcealment) common.SegmentDecoder {
+	decoders := make(map[uint64]common.SegmentDecoder)
+	return func(segment common.VoiceSegment) ([]float32, error) {
+		decode := decoders[segment.SteamID]
+		if decode == nil {
+			var err error
+			decode, err = newSpeakerDecoder(format, concealment)
+			if err != nil {
+				return nil, err
+			}
+			decoders[segment.SteamID] = decode
+		}
 
-	enc := wav.NewEncoder(outFile, sampleRate, 32, 1, 1)
-	defer enc.Close()
+		return decode(segment)
+	}
+}
 
-	buf := &audio.IntBuffer{
-		Data: pcmBuffer,
-		Format: &audio.Format{
-			SampleRate:  sampleRate,
-			NumChannels: 1,
+// newVoiceCodec returns a codec whose decoders share the speaker decoders, so that a voice split in several files,
+// i.e. alive and dead, is decoded with a single state.
+func newVoiceCodec(format msgs2.VoiceDataFormatT, concealment common.PacketLossConcealment) common.VoiceCodec {
+	decode := newSegmentDecoder(format, concealment)
+	return common.VoiceCodec{
+		Format: getAudioFormat(format),
+		NewDecoder: func() (common.SegmentDecoder, error) {
+			return decode, nil
 		},
+		ToInts:   samplesToInt32,
+		MixChunk: mixChunk,
 	}
+}
 
-	if err := enc.Write(buf); err != nil {
-		common.HandleError(common.Error{
-			Message:  "Couldn't write WAV file",
-			Err:      err,
-			ExitCode: common.WavFileCreationError,
-		})
-	}
+func generateAudioFilesWithDemoLength(segmentsPerPlayer map[string][]common.VoiceSegment, players map[string]common.Player, format msgs2.VoiceDataFormatT, durationSeconds float64, options common.ExtractOptions) ([]string, error) {
+	return common.WritePlayerFiles(segmentsPerPlayer, players, newVoiceCodec(format, options.Concealment), true, durationSeconds, options)
 }
 
-func generateAudioFilesWithDemoLength(segmentsPerPlayer map[string][]common.VoiceSegment, format msgs2.VoiceDataFormatT, durationSeconds float64, demoName string, outputPath string) {
-	for playerID, segments := range segmentsPerPlayer {
-		wavFilePath := buildPlayerWavFileName(outputPath, demoName, playerID)
-		if format == msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_OPUS {
-			writeOpusVoiceSegmentsToWav(segments, wavFilePath, durationSeconds)
-		} else {
-			writeSteamVoiceSegmentsToWav(segments, wavFilePath, durationSeconds)
-		}
-	}
+func generateAudioFilesWithCompactLength(segmentsPerPlayer map[string][]common.VoiceSegment, players map[string]common.Player, format msgs2.VoiceDataFormatT, options common.ExtractOptions) ([]string, error) {
+	return common.WritePlayerFiles(segmentsPerPlayer, players, newVoiceCodec(format, options.Concealment), false, 0, options)
 }
 
-func generateAudioFilesWithCompactLength(segmentsPerPlayer map[string][]common.VoiceSegment, format msgs2.VoiceDataFormatT, demoName string, options common.ExtractOptions) {
-	sampleRate := getFormatSampleRate(format)
-	isOpusFormat := format == msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_OPUS
+func writeCompactVoiceSegments(segments []common.VoiceSegment, format msgs2.VoiceDataFormatT, sink common.AudioSink, options common.ExtractOptions) error {
+	decode := newSegmentDecoder(format, options.Concealment)
 
-	for playerID, segments := range segmentsPerPlayer {
-		if len(segments) == 0 {
+	position := 0
+	for _, segment := range segments {
+		samples, err := decode(segment)
+		if err != nil {
+			options.Logf("%s\n", err)
 			continue
 		}
 
-		wavFilePath := buildPlayerWavFileName(options.OutputPath, demoName, playerID)
-		outFile, err := common.CreateWavFile(wavFilePath)
-		if err != nil {
+		if len(samples) == 0 {
 			continue
 		}
-		defer outFile.Close()
-
-		enc := wav.NewEncoder(outFile, sampleRate, 32, 1, 1)
-		defer enc.Close()
-
-		if isOpusFormat {
-			decoder, err := NewOpusDecoder(sampleRate, 1)
-			if err != nil {
-				continue
-			}
 
-			for _, segment := range segments {
-				samples, err := Decode(decoder, segment.Data)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
+		err = sink.Write(common.AudioFrame{
+			Position:  position,
+			Timestamp: segment.Timestamp,
+			Data:      samplesToInt32(samples),
+		})
+		if err != nil {
+			return err
+		}
+		options.Placements.Record(segment, sink, position, len(samples), getFormatSampleRate(format))
+		position += len(samples)
+	}
 
-				if len(samples) == 0 {
-					continue
-				}
+	return nil
+}
 
-				pcmBuffer := samplesToInt32(samples)
-				err = writeAudioToWav(enc, sampleRate, pcmBuffer)
-				if err != nil {
-					continue
-				}
-			}
-		} else {
-			decoder, err := NewSteamDecoder(sampleRate, 1)
+// generateOggOpusFiles writes the original Opus packets of each player into Ogg Opus files. With the split-full mode,
+// silent packets are inserted between voice segments so that the files have the demo duration.
+func generateOggOpusFiles(segmentsPerPlayer map[string][]common.VoiceSegment, durationSeconds float64, options common.ExtractOptions) ([]string, error) {
+	if options.Mode == common.ModeClips {
+		utterances := options.GetUtterances(segmentsPerPlayer)
+		files := make([]string, 0, len(utterances))
+		for _, utterance := range utterances {
+			filePath := filepath.Join(options.OutputPath, common.BuildClipOutputName(options.DemoName, utterance)+".opus")
+			err := writeOggOpusFile(utterance.Segments, filePath, durationSeconds, options)
 			if err != nil {
-				continue
+				return files, err
 			}
 
-			for _, segment := range segments {
-				chunk, err := DecodeChunk(segment.Data)
-				if err != nil || chunk == nil || len(chunk.Data) == 0 {
-					continue
-				}
+			files = append(files, filePath)
+		}
 
-				samples, err := decoder.Decode(chunk.Data)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
+		return files, nil
+	}
 
-				if len(samples) == 0 {
-					continue
-				}
+	files := make([]string, 0, len(segmentsPerPlayer))
+	for playerID, segments := range segmentsPerPlayer {
+		if len(segments) == 0 {
+			continue
+		}
 
-				pcmBuffer := samplesToInt32(samples)
-				writeAudioToWav(enc, sampleRate, pcmBuffer)
-			}
+		filePath := filepath.Join(options.OutputPath, common.BuildPlayerOutputName(options.DemoName, playerID)+".opus")
+		err := writeOggOpusFile(segments, filePath, durationSeconds, options)
+		if err != nil {
+			return files, err
 		}
+
+		files = append(files, filePath)
 	}
+
+	return files, nil
 }
 
-func writeSteamVoiceSegmentsToWav(segments []common.VoiceSegment, fileName string, totalDuration float64) {
-	decoder, err := NewSteamDecoder(steamSampleRate, 1)
+func writeOggOpusFile(segments []common.VoiceSegment, filePath string, durationSeconds float64, options common.ExtractOptions) error {
+	file, err := os.Create(filePath)
 	if err != nil {
-		return
+		return common.NewWavFileCreationError("Couldn't create Ogg Opus file", err)
 	}
+	defer file.Close()
 
-	totalSamples := int(totalDuration * float64(steamSampleRate))
-	pcmBuffer := make([]int, totalSamples)
-	var previousEndPos int = 0
-
+	isFullLength := options.Mode == common.ModeSplitFull
+	writer := NewOggOpusWriter(file, crc32.ChecksumIEEE([]byte(filePath)))
 	for _, segment := range segments {
-		chunk, err := DecodeChunk(segment.Data)
+		samples, err := GetOpusPacketSampleCount(segment.Data)
 		if err != nil {
-			fmt.Println(err)
+			options.Logf("%s\n", err)
 			continue
 		}
 
-		// Not silent frame
-		if chunk != nil && len(chunk.Data) > 0 {
-			samples, err := decoder.Decode(chunk.Data)
-
+		if isFullLength {
+			err = writer.WriteSilence(int64(segment.Timestamp * opusSampleRate))
 			if err != nil {
-				common.HandleError(common.Error{
-					Message:  "Failed to decode voice data",
-					Err:      err,
-					ExitCode: common.DecodingError,
-				})
+				return common.NewWavFileCreationError("Couldn't write Ogg Opus file", err)
 			}
+		}
 
-			startPos := int(segment.Timestamp * float64(steamSampleRate))
-			if startPos < previousEndPos {
-				startPos = previousEndPos
-			}
+		options.Placements.RecordFile(segment, filepath.Base(filePath), int(writer.Granule()), samples, opusSampleRate)
+		err = writer.WritePacket(segment.Data, samples)
+		if err != nil {
+			return common.NewWavFileCreationError("Couldn't write Ogg Opus file", err)
+		}
+	}
 
-			if startPos >= totalSamples {
-				fmt.Printf("Warning: Voice segment at %f seconds exceeds demo duration\n", segment.Timestamp)
-				continue
-			}
+	if isFullLength {
+		err = writer.WriteSilence(int64(durationSeconds * opusSampleRate))
+		if err != nil {
+			return common.NewWavFileCreationError("Couldn't write Ogg Opus file", err)
+		}
+	}
 
-			for i, sample := range samples {
-				samplePos := startPos + i
-				if samplePos >= totalSamples {
-					break
-				}
-				pcmBuffer[samplePos] = int(sample * math.MaxInt32)
-			}
+	err = writer.Close()
+	if err != nil {
+		return common.NewWavFileCreationError("Couldn't write Ogg Opus file", err)
+	}
+
+	return nil
+}
 
-			previousEndPos = startPos + len(samples)
+// generateClipAudioFiles writes 1 file per utterance without silence.
+func generateClipAudioFiles(segmentsPerPlayer map[string][]common.VoiceSegment, players map[string]common.Player, format msgs2.VoiceDataFormatT, options common.ExtractOptions) ([]string, error) {
+	utterances := options.GetUtterances(segmentsPerPlayer)
+	files := make([]string, 0, len(utterances))
+	for _, utterance := range utterances {
+		sink, err := options.CreateClipSink(players[utterance.PlayerID], utterance, getAudioFormat(format))
+		if err != nil {
+			return files, err
+		}
+
+		err = writeCompactVoiceSegments(utterance.Segments, format, sink, options)
+		err = common.CloseSink(sink, err)
+		if err != nil {
+			return files, err
+		}
+
+		if path := common.GetSinkPath(sink); path != "" {
+			files = append(files, path)
 		}
 	}
 
-	writePCMToWav(pcmBuffer, steamSampleRate, fileName)
+	return files, nil
 }
 
-func writeOpusVoiceSegmentsToWav(segments []common.VoiceSegment, fileName string, durationSeconds float64) {
-	decoder, err := NewOpusDecoder(opusSampleRate, 1)
-	if err != nil {
-		return
+// generateRoundAudioFiles writes 1 merged file per round and optionally 1 file per player and round.
+func generateRoundAudioFiles(segmentsPerPlayer map[string][]common.VoiceSegment, players map[string]common.Player, format msgs2.VoiceDataFormatT, rounds []common.Round, durationSeconds float64, options common.ExtractOptions) ([]string, error) {
+	return common.GenerateRoundFiles(segmentsPerPlayer, rounds, durationSeconds, options, func(roundSegments map[string][]common.VoiceSegment, roundDurationSeconds float64, roundOptions common.ExtractOptions) ([]string, error) {
+		files, err := generateAudioFileWithMergedVoices(roundSegments, format, roundDurationSeconds, roundOptions)
+		if err != nil || !options.SplitRoundsPerPlayer {
+			return files, err
+		}
+
+		playerFiles, err := generateAudioFilesWithDemoLength(roundSegments, players, format, roundDurationSeconds, roundOptions)
+
+		return append(files, playerFiles...), err
+	})
+}
+
+func generateMultitrackAudioFile(segmentsPerPlayer map[string][]common.VoiceSegment, players map[string]common.Player, format msgs2.VoiceDataFormatT, durationSeconds float64, options common.ExtractOptions) ([]string, error) {
+	audioFormat := getAudioFormat(format)
+	totalSamples := int(durationSeconds * float64(audioFormat.SampleRate))
+	sortedPlayers := common.SortPlayers(players, segmentsPerPlayer)
+	tracks := make([][]common.TrackSegment, len(sortedPlayers))
+	for index, player := range sortedPlayers {
+		track, err := decodeTrack(segmentsPerPlayer[player.ID], format, totalSamples, options)
+		if err != nil {
+			return nil, err
+		}
+		tracks[index] = track
 	}
 
-	totalSamples := int(durationSeconds * float64(opusSampleRate))
-	// store samples in a sparse map to avoid large memory usage
-	samplesMap := make(map[int][]float32)
-	// store start positions of segments that contain audio data
-	activePositions := make([]int, 0)
+	return common.GenerateMultitrackFile(tracks, sortedPlayers, audioFormat, totalSamples, options)
+}
+
+// decodeTrack decodes the player's voice segments and places them at their original timestamps.
+func decodeTrack(segments []common.VoiceSegment, format msgs2.VoiceDataFormatT, totalSamples int, options common.ExtractOptions) ([]common.TrackSegment, error) {
+	decode := newSegmentDecoder(format, options.Concealment)
 
-	var previousEndPosition = 0
-	// decode and store each voice segment in the sparse map
+	sampleRate := getFormatSampleRate(format)
+	track := make([]common.TrackSegment, 0, len(segments))
+	previousEndPosition := 0
 	for _, segment := range segments {
-		samples, err := Decode(decoder, segment.Data)
+		samples, err := decode(segment)
 		if err != nil {
-			fmt.Println(err)
+			options.Logf("%s\n", err)
 			continue
 		}
 
-		startPosition := int(segment.Timestamp * float64(opusSampleRate))
-		if startPosition < previousEndPosition {
-			startPosition = previousEndPosition
+		if len(samples) == 0 {
+			continue
 		}
 
+		startPosition := max(int(segment.Timestamp*float64(sampleRate)), previousEndPosition)
 		if startPosition >= totalSamples {
-			fmt.Printf("Warning: Voice segment at %f seconds exceeds demo duration\n", segment.Timestamp)
+			options.Logf("Warning: Voice segment at %f seconds exceeds demo duration\n", segment.Timestamp)
 			continue
 		}
 
-		samplesMap[startPosition] = samples
-		activePositions = append(activePositions, startPosition)
+		// truncate the segment if it exceeds the demo duration
+		if startPosition+len(samples) > totalSamples {
+			samples = samples[:totalSamples-startPosition]
+		}
+
+		track = append(track, common.TrackSegment{
+			Segment:  segment,
+			Position: startPosition,
+			Samples:  samplesToInt32(samples),
+		})
 		previousEndPosition = startPosition + len(samples)
 	}
 
-	// no voice
-	if len(activePositions) == 0 {
-		return
-	}
+	return track, nil
+}
 
-	outFile, err := common.CreateWavFile(fileName)
-	if err != nil {
-		return
-	}
-	defer outFile.Close()
-
-	enc := wav.NewEncoder(outFile, opusSampleRate, 32, 1, 1)
-	defer enc.Close()
-
-	silenceBufferSize := 8192 // small buffer size for silence
-	silenceBuffer := make([]int, silenceBufferSize)
-	lastPosition := 0
-	for _, startPosition := range activePositions {
-		silenceLength := startPosition - lastPosition
-		if silenceLength > 0 {
-			// write silence in chunks to avoid large memory allocations
-			for silenceLength > silenceBufferSize {
-				err = writeAudioToWav(enc, opusSampleRate, silenceBuffer)
-				if err != nil {
-					return
-				}
-				silenceLength -= silenceBufferSize
-			}
+// mixChunk mixes the segments that overlap with the chunk [chunkStart, chunkEnd[ and returns its interleaved samples.
+func mixChunk(voiceSegments []common.MixedSegment, chunkStart int, chunkEnd int, numChannels int) []int {
+	chunkLength := chunkEnd - chunkStart
+	// interleaved samples
+	samples := make([]float32, chunkLength*numChannels)
+	activeSources := make([]int, chunkLength*numChannels)
+
+	// find segments that overlap with the current chunk
+	for _, segment := range voiceSegments {
+		segmentEnd := segment.End()
+		// check if this segment does not overlap with the current chunk
+		if segmentEnd <= chunkStart || segment.Position >= chunkEnd {
+			continue
+		}
 
-			// write remaining silence
-			if silenceLength > 0 {
-				err = writeAudioToWav(enc, opusSampleRate, silenceBuffer[:silenceLength])
-				if err != nil {
-					return
-				}
-			}
+		// calculate the start and end of the overlap
+		overlapStart := segment.Position
+		if overlapStart < chunkStart {
+			overlapStart = chunkStart
+		}
+		overlapEnd := segmentEnd
+		if overlapEnd > chunkEnd {
+			overlapEnd = chunkEnd
 		}
 
-		// write the player's voice
-		samples := samplesMap[startPosition]
-		pcmBuffer := samplesToInt32(samples)
-		err = writeAudioToWav(enc, opusSampleRate, pcmBuffer)
-		if err != nil {
-			return
+		// add samples in the chunk and track active sources (players talking at the same time)
+		for i := overlapStart; i < overlapEnd; i++ {
+			sampleIndex := i - chunkStart
+			sampleStartPosition := i - segment.Position
+
+			if sampleStartPosition >= 0 && sampleStartPosition < len(segment.Samples) {
+				sample := segment.Samples[sampleStartPosition]
+				if sample != 0 { // ignore silence
+					for channel, gain := range segment.Gains {
+						if gain == 0 {
+							continue
+						}
+						samples[sampleIndex*numChannels+channel] += sample * float32(gain)
+						activeSources[sampleIndex*numChannels+channel]++
+					}
+				}
+			}
 		}
-		lastPosition = startPosition + len(samples)
 	}
 
-	if lastPosition >= totalSamples {
-		return
-	}
+	// normalize and mix samples in the chunk
+	for sampleIndex := range samples {
+		// ignore silence
+		if samples[sampleIndex] == 0 || activeSources[sampleIndex] == 0 {
+			continue
+		}
 
-	// write remaining silence at the end of the file
-	remainingSilence := totalSamples - lastPosition
-	for remainingSilence > silenceBufferSize {
-		err = writeAudioToWav(enc, opusSampleRate, silenceBuffer)
-		if err != nil {
-			return
+		// normalize the sample if several players are talking at the same time
+		if activeSources[sampleIndex] > 1 {
+			mixCoeff := 1.0 / float32(math.Sqrt(float64(activeSources[sampleIndex])))
+			samples[sampleIndex] *= mixCoeff
 		}
-		remainingSilence -= silenceBufferSize
 	}
 
-	if remainingSilence > 0 {
-		writeAudioToWav(enc, opusSampleRate, silenceBuffer[:remainingSilence])
+	// find the maximum value in the chunk to potentially normalize
+	maxSampleValue := float32(1.0)
+	for _, v := range samples {
+		f := math.Abs(float64(v))
+		if f > float64(maxSampleValue) {
+			maxSampleValue = float32(f)
+		}
 	}
-}
 
-func generateAudioFileWithMergedVoices(voiceDataPerPlayer map[string][]common.VoiceSegment, format msgs2.VoiceDataFormatT, durationSeconds float64, demoName string, outputPath string) {
-	var err error
-	var opusDecoder *opus.Decoder
-	var steamDecoder *SteamDecoder
-	sampleRate := getFormatSampleRate(format)
-	isOpusFormat := format == msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_OPUS
-
-	if isOpusFormat {
-		opusDecoder, err = NewOpusDecoder(sampleRate, 1)
-		if err != nil {
-			return
-		}
-	} else {
-		steamDecoder, err = NewSteamDecoder(sampleRate, 1)
-		if err != nil {
-			return
+	// normalize if needed
+	if maxSampleValue > 1.0 {
+		for i := range samples {
+			samples[i] /= maxSampleValue
 		}
 	}
 
-	totalSamples := int(durationSeconds * float64(sampleRate))
-	wavFilePath := filepath.Join(outputPath, demoName+".wav")
-	outFile, err := common.CreateWavFile(wavFilePath)
-	if err != nil {
-		return
-	}
-	defer outFile.Close()
+	return samplesToInt32(samples)
+}
 
-	enc := wav.NewEncoder(outFile, sampleRate, 32, 1, 1)
-	defer enc.Close()
+func generateAudioFileWithMergedVoices(voiceDataPerPlayer map[string][]common.VoiceSegment, format msgs2.VoiceDataFormatT, durationSeconds float64, options common.ExtractOptions) ([]string, error) {
+	decode := newSegmentDecoder(format, options.Concealment)
 
-	type VoiceSegmentInfo struct {
-		StartPosition int
-		Samples       []float32
-	}
+	audioFormat := getAudioFormat(format)
+	numChannels := options.GetMergedChannelCount()
+	audioFormat.NumChannels = numChannels
+	sampleRate := audioFormat.SampleRate
+	totalSamples := int(durationSeconds * float64(sampleRate))
 
 	// decode and store players' voice segments
-	voiceSegments := make([]VoiceSegmentInfo, 0)
+	voiceSegments := make([]common.MixedSegment, 0)
 	for _, segments := range voiceDataPerPlayer {
 		previousEndPosition := 0
 		for _, segment := range segments {
-			var pcm []float32
-			if isOpusFormat {
-				chunk, err := Decode(opusDecoder, segment.Data)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
-				pcm = chunk
-			} else {
-				chunk, err := DecodeChunk(segment.Data)
-				if err != nil || chunk == nil || len(chunk.Data) == 0 {
-					continue
-				}
-				samples, err := steamDecoder.Decode(chunk.Data)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
-				pcm = samples
+			pcm, err := decode(segment)
+			if err != nil {
+				options.Logf("%s\n", err)
+				continue
 			}
 
 			if len(pcm) == 0 {
@@ -408,126 +445,98 @@ func generateAudioFileWithMergedVoices(voiceDataPerPlayer map[string][]common.Vo
 			}
 
 			if startPosition >= totalSamples {
-				fmt.Printf("Warning: Voice segment at %f seconds exceeds demo duration\n", segment.Timestamp)
+				options.Logf("Warning: Voice segment at %f seconds exceeds demo duration\n", segment.Timestamp)
 				continue
 			}
 
-			voiceSegments = append(voiceSegments, VoiceSegmentInfo{
-				StartPosition: startPosition,
-				Samples:       pcm,
+			voiceSegments = append(voiceSegments, common.MixedSegment{
+				Segment:  segment,
+				Position: startPosition,
+				Samples:  pcm,
+				Gains:    options.GetChannelGains(segment),
 			})
 
 			previousEndPosition = startPosition + len(pcm)
 		}
 	}
 
-	// process in small chunks to avoid high memory usage
-	const chunkSize = 8192
-	for chunkStart := 0; chunkStart < totalSamples; chunkStart += chunkSize {
-		chunkEnd := chunkStart + chunkSize
-		if chunkEnd > totalSamples {
-			chunkEnd = totalSamples
-		}
-
-		chunkLength := chunkEnd - chunkStart
-		samples := make([]float32, chunkLength)
-		activeSources := make([]int, chunkLength)
-
-		// find segments that overlap with the current chunk
-		for _, segment := range voiceSegments {
-			segmentEnd := segment.StartPosition + len(segment.Samples)
-			// check if this segment does not overlap with the current chunk
-			if segmentEnd <= chunkStart || segment.StartPosition >= chunkEnd {
-				continue
-			}
-
-			// calculate the start and end of the overlap
-			overlapStart := segment.StartPosition
-			if overlapStart < chunkStart {
-				overlapStart = chunkStart
-			}
-			overlapEnd := segmentEnd
-			if overlapEnd > chunkEnd {
-				overlapEnd = chunkEnd
-			}
-
-			// add samples in the chunk and track active sources (players talking at the same time)
-			for i := overlapStart; i < overlapEnd; i++ {
-				sampleIndex := i - chunkStart
-				sampleStartPosition := i - segment.StartPosition
-
-				if sampleStartPosition >= 0 && sampleStartPosition < len(segment.Samples) {
-					sample := segment.Samples[sampleStartPosition]
-					if sample != 0 { // ignore silence
-						samples[sampleIndex] += sample
-						activeSources[sampleIndex]++
-					}
-				}
-			}
-		}
-
-		// normalize and mix samples in the chunk
-		for sampleIndex := range samples {
-			// ignore silence
-			if samples[sampleIndex] == 0 || activeSources[sampleIndex] == 0 {
-				continue
-			}
-
-			// normalize the sample if several players are talking at the same time
-			if activeSources[sampleIndex] > 1 {
-				mixCoeff := 1.0 / float32(math.Sqrt(float64(activeSources[sampleIndex])))
-				samples[sampleIndex] *= mixCoeff
-			}
-		}
+	sink, err := options.CreateMergedSink(audioFormat)
+	if err != nil {
+		return nil, err
+	}
 
-		// find the maximum value in the chunk to potentially normalize
-		maxSampleValue := float32(1.0)
-		for _, v := range samples {
-			f := math.Abs(float64(v))
-			if f > float64(maxSampleValue) {
-				maxSampleValue = float32(f)
-			}
-		}
+	for _, segment := range voiceSegments {
+		options.Placements.Record(segment.Segment, sink, segment.Position, min(len(segment.Samples), totalSamples-segment.Position), sampleRate)
+	}
 
-		// normalize if needed
-		if maxSampleValue > 1.0 {
-			for i := range samples {
-				samples[i] /= maxSampleValue
-			}
-		}
+	// process in small chunks to avoid high memory usage
+	err = common.WriteMixedChunks(sink, voiceSegments, totalSamples, audioFormat, mixChunk)
+	err = common.CloseSink(sink, err)
+	if err != nil {
+		return nil, err
+	}
 
-		pcmBuffer := samplesToInt32(samples)
-		err = writeAudioToWav(enc, sampleRate, pcmBuffer)
-		if err != nil {
-			return
-		}
+	if path := common.GetSinkPath(sink); path != "" {
+		return []string{path}, nil
 	}
 
-	wavFilePath = filepath.Join(outputPath, demoName+".wav")
+	return nil, nil
 }
 
-func Extract(options common.ExtractOptions) {
-	common.AssertLibraryFilesExist()
+func Extract(ctx context.Context, reader io.Reader, options common.ExtractOptions) (*common.Result, error) {
+	err := common.CheckLibraryFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.HasSidecarFiles() {
+		options.Placements = common.NewPlacementRecorder()
+	}
 
 	demoPath := options.DemoPath
 	parserConfig := dem.DefaultParserConfig
-	parser := dem.NewParserWithConfig(options.File, parserConfig)
+	parser := dem.NewParserWithConfig(reader, parserConfig)
 	defer parser.Close()
 	var segmentsPerPlayer = map[string][]common.VoiceSegment{}
+	var players = map[string]common.Player{}
 	var format msgs2.VoiceDataFormatT
+	var unsupportedCodec *common.UnsupportedCodec
+	// with the split-compact, split-full and single-full modes, voices are written while the demo is parsed
+	var voiceStream *common.VoiceStream
+	var streamErr error
+
+	parser.RegisterEventHandler(func(events.FrameDone) {
+		if ctx.Err() != nil {
+			parser.Cancel()
+		}
+	})
+
+	playerNames := common.NewPlayerNameCache()
+	clock := common.NewClock(parser, options.Timebase)
+	roundTracker := common.NewRoundTracker(parser, clock)
+	eventTracker := common.NewEventTracker(parser, clock)
+	teamTracker := common.NewTeamTracker(parser)
+	povTracker := common.NewPOVTracker(parser, options)
+	lossTracker := newPacketLossTracker()
+	timeWindowTracker := common.NewTimeWindowTracker(parser, clock, roundTracker, options)
+	periodTracker := common.NewPeriodTracker(parser, clock, options)
 
 	parser.RegisterNetMessageHandler(func(m *msgs2.CSVCMsg_VoiceData) {
+		if streamErr != nil {
+			return
+		}
+
 		steamID := m.GetXuid()
 		if len(options.SteamIDs) > 0 && !slices.Contains(options.SteamIDs, fmt.Sprintf("%d", steamID)) {
 			return
 		}
 
-		playerID := common.GetPlayerID(parser, steamID)
+		playerID := playerNames.GetPlayerID(parser, steamID)
 		// Opus format since the arms race update (07/02/2024), Steam Voice format before that.
 		format = m.GetAudio().GetFormat()
 
 		if format != msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_STEAM && format != msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_OPUS {
-			common.UnsupportedCodecError = &common.UnsupportedCodec{
+			unsupportedCodec = &common.UnsupportedCodec{
 				Name: format.String(),
 			}
 			parser.Cancel()
@@ -535,52 +544,163 @@ func Extract(options common.ExtractOptions) {
 		}
 
 		if playerID == "" {
+			options.Logf("Unable to find player's name with SteamID %d\n", steamID)
 			return
 		}
 
 		if segmentsPerPlayer[playerID] == nil {
 			segmentsPerPlayer[playerID] = make([]common.VoiceSegment, 0)
+			players[playerID] = common.Player{
+				SteamID: steamID,
+				Name:    playerNames.GetPlayerName(parser, steamID),
+				ID:      playerID,
+			}
 		}
 
-		segmentsPerPlayer[playerID] = append(segmentsPerPlayer[playerID], common.VoiceSegment{
-			Data:      m.Audio.VoiceData,
-			Timestamp: parser.CurrentTime().Seconds(),
-		})
+		// a message may carry several Opus packets, each one is a segment so that packets are decoded and muxed one by one
+		packets := [][]byte{m.Audio.VoiceData}
+		lostPackets := 0
+		if format == msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_OPUS {
+			packets = SplitOpusPackets(m.Audio.VoiceData, m.Audio.GetPacketOffsets())
+
+			var isLate bool
+			lostPackets, isLate = lossTracker.track(steamID, m.GetAudio())
+			if isLate {
+				player := players[playerID]
+				player.LatePackets += len(packets)
+				players[playerID] = player
+				// the packets have already been counted as lost and concealed, decoding them now would repeat audio out
+				// of order, without concealment they are decoded as they are received
+				if options.Concealment.IsEnabled() {
+					return
+				}
+			}
+		}
+
+		side, teamName := teamTracker.GetPlayerTeam(steamID)
+		for _, packet := range packets {
+			segment := common.VoiceSegment{
+				Data:        packet,
+				Timestamp:   clock.Seconds(),
+				Tick:        clock.Tick(),
+				ServerTick:  clock.ServerTick(),
+				DemoTick:    clock.DemoTick(),
+				IsAlive:     common.IsPlayerAlive(parser, steamID),
+				Side:        side,
+				TeamName:    teamName,
+				SteamID:     steamID,
+				PlayerID:    playerID,
+				Index:       len(segmentsPerPlayer[playerID]),
+				Spatial:     povTracker.GetSpatialPosition(steamID),
+				LostPackets: lostPackets,
+			}
+			// the lost packets are concealed before the first packet of the message
+			lostPackets = 0
+
+			if voiceStream == nil && options.CanStreamVoices() {
+				voiceStream = common.NewVoiceStream(newVoiceCodec(format, options.Concealment), options)
+			}
+			if voiceStream != nil {
+				streamErr = voiceStream.Write(segment, players[playerID])
+				if streamErr != nil {
+					parser.Cancel()
+					return
+				}
+				// the voice data has been written, only the metadata is kept for the sidecar files
+				segment.Data = nil
+			}
+			segmentsPerPlayer[playerID] = append(segmentsPerPlayer[playerID], segment)
+		}
 	})
 
-	err := parser.ParseToEnd()
+	err = parser.ParseToEnd()
 
 	isCorruptedDemo := errors.Is(err, dem.ErrUnexpectedEndOfDemo)
-	isCanceled := errors.Is(err, dem.ErrCancelled)
-	if err != nil && !isCorruptedDemo && !isCanceled {
-		common.HandleError(common.Error{
-			Message:  fmt.Sprintf("Failed to parse demo: %s\n", demoPath),
-			Err:      err,
-			ExitCode: common.ParsingError,
-		})
-		return
+	// the parsing is canceled once the end of the time window is reached
+	isCanceled := errors.Is(err, dem.ErrCancelled) && (!timeWindowTracker.HasEnded() || unsupportedCodec != nil || ctx.Err() != nil)
+	isFailed := err != nil && !isCorruptedDemo && !errors.Is(err, dem.ErrCancelled)
+	if voiceStream != nil && (streamErr != nil || isFailed || isCanceled) {
+		// close the streamed outputs without completing them
+		_, streamErr = voiceStream.Close(0, cmp.Or(streamErr, err))
+		if !isFailed && unsupportedCodec == nil && ctx.Err() == nil {
+			return nil, streamErr
+		}
+	}
+
+	if isFailed {
+		return nil, common.NewError(fmt.Sprintf("Failed to parse demo: %s\n", demoPath), err, common.ParsingError)
 	}
 
 	if isCanceled {
-		return
+		if unsupportedCodec != nil {
+			return nil, common.NewUnsupportedCodecError(unsupportedCodec)
+		}
+
+		return nil, ctx.Err()
+	}
+
+	durationSeconds := clock.Seconds()
+	window, err := timeWindowTracker.Window(durationSeconds)
+	if err != nil {
+		return nil, err
 	}
 
+	segmentsPerPlayer, players = window.SliceSegments(segmentsPerPlayer, players)
+	segmentsPerPlayer, players = options.FilterSegments(segmentsPerPlayer, players)
+	timeline := common.BuildTimeline(periodTracker.Periods(durationSeconds), segmentsPerPlayer, window.GetDuration(durationSeconds), window, clock, options)
+	segmentsPerPlayer, players = timeline.MapSegments(segmentsPerPlayer, players)
 	if len(segmentsPerPlayer) == 0 {
-		common.HandleError(common.Error{
-			Message:  fmt.Sprintf("No voice data found in demo %s\n", demoPath),
-			ExitCode: common.NoVoiceDataFound,
-		})
-		return
+		return nil, common.NewError(fmt.Sprintf("No voice data found in demo %s\n", demoPath), nil, common.NoVoiceDataFound)
+	}
+
+	options.Logf("Parsing done, generating audio files...\n")
+	rounds := roundTracker.Rounds(durationSeconds)
+	durationSeconds = timeline.GetDuration(window.GetDuration(durationSeconds))
+	result := &common.Result{
+		Game:            common.GameCS2,
+		DurationSeconds: durationSeconds,
+		Players:         common.SortPlayers(players, segmentsPerPlayer),
+		Rounds:          timeline.MapRounds(window.SliceRounds(rounds)),
+		Events:          timeline.MapEvents(window.SliceEvents(eventTracker.Events(rounds))),
+		Window:          window,
+		Timeline:        timeline,
 	}
+	common.LogPacketLoss(result.Players, options)
 
-	fmt.Println("Parsing done, generating audio files...")
-	durationSeconds := parser.CurrentTime().Seconds()
-	demoName := strings.TrimSuffix(filepath.Base(demoPath), filepath.Ext(demoPath))
-	if options.Mode == common.ModeSingleFull {
-		generateAudioFileWithMergedVoices(segmentsPerPlayer, format, durationSeconds, demoName, options.OutputPath)
+	playerFilesSegments, playerFilesPlayers := options.GetPlayerFilesSegments(segmentsPerPlayer, players)
+	var files []string
+	if options.Format == common.FormatOpus {
+		if format != msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_OPUS {
+			return nil, common.NewError("The opus format requires Opus voice data, Steam Voice data can't be exported without decoding it", nil, common.UnsupportedAudioCodec)
+		}
+
+		files, err = generateOggOpusFiles(playerFilesSegments, durationSeconds, options)
+	} else if voiceStream != nil {
+		files, err = voiceStream.Close(durationSeconds, nil)
+	} else if options.Mode == common.ModeSingleFull {
+		files, err = generateAudioFileWithMergedVoices(segmentsPerPlayer, format, durationSeconds, options)
+	} else if options.Mode == common.ModeMultitrack {
+		files, err = generateMultitrackAudioFile(segmentsPerPlayer, players, format, durationSeconds, options)
+	} else if options.Mode == common.ModeSplitRounds {
+		files, err = generateRoundAudioFiles(segmentsPerPlayer, players, format, result.Rounds, durationSeconds, options)
+	} else if options.Mode == common.ModeSplitTeam {
+		files, err = common.GenerateTeamFiles(segmentsPerPlayer, options, func(teamSegments map[string][]common.VoiceSegment, teamOptions common.ExtractOptions) ([]string, error) {
+			return generateAudioFileWithMergedVoices(teamSegments, format, durationSeconds, teamOptions)
+		})
+	} else if options.Mode == common.ModeClips {
+		files, err = generateClipAudioFiles(segmentsPerPlayer, players, format, options)
 	} else if options.Mode == common.ModeSplitFull {
-		generateAudioFilesWithDemoLength(segmentsPerPlayer, format, durationSeconds, demoName, options.OutputPath)
+		files, err = generateAudioFilesWithDemoLength(playerFilesSegments, playerFilesPlayers, format, durationSeconds, options)
 	} else {
-		generateAudioFilesWithCompactLength(segmentsPerPlayer, format, demoName, options)
+		files, err = generateAudioFilesWithCompactLength(playerFilesSegments, playerFilesPlayers, format, options)
 	}
+	result.Files = files
+	if err != nil {
+		return result, err
+	}
+
+	sidecarFiles, err := common.WriteSidecarFiles(result, segmentsPerPlayer, clock.DemoTickRate(), options)
+	result.Files = append(result.Files, sidecarFiles...)
+
+	return result, err
 }
@@ -0,0 +1,131 @@
+package cs2
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/akiver/csgo-voice-extractor/common"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/msgs2"
+	"gopkg.in/hraban/opus.v2"
+)
+
+const testFrameSize = 960 // 20 ms at 48 kHz
+
+// encodeSpeaker returns the Opus packets of a sine wave, each speaker has its own frequency so that decoding a packet
+// with the state of another speaker changes the output.
+func encodeSpeaker(t *testing.T, steamID uint64, frequency float64, packetCount int) []common.VoiceSegment {
+	encoder, err := opus.NewEncoder(opusSampleRate, 1, opus.AppVoIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments := make([]common.VoiceSegment, 0, packetCount)
+	for index := range packetCount {
+		pcm := make([]float32, testFrameSize)
+		for sampleIndex := range pcm {
+			position := float64(index*testFrameSize + sampleIndex)
+			pcm[sampleIndex] = float32(0.5 * math.Sin(2*math.Pi*frequency*position/opusSampleRate))
+		}
+
+		data := make([]byte, 1000)
+		length, err := encoder.EncodeFloat32(pcm, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		segments = append(segments, common.VoiceSegment{
+			Data:    data[:length],
+			SteamID: steamID,
+			Index:   index,
+		})
+	}
+
+	return segments
+}
+
+func decodeSegments(t *testing.T, decode common.SegmentDecoder, segments []common.VoiceSegment) [][]float32 {
+	decoded := make([][]float32, 0, len(segments))
+	for _, segment := range segments {
+		samples, err := decode(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, samples)
+	}
+
+	return decoded
+}
+
+func TestSegmentDecoderDecodesEachSpeakerWithItsOwnState(t *testing.T) {
+	const packetCount = 20
+	speakers := map[uint64][]common.VoiceSegment{
+		76561198000000001: encodeSpeaker(t, 76561198000000001, 220, packetCount),
+		76561198000000002: encodeSpeaker(t, 76561198000000002, 880, packetCount),
+	}
+
+	// both speakers talk at the same time, their packets are received interleaved
+	interleaved := make([]common.VoiceSegment, 0, packetCount*2)
+	for index := range packetCount {
+		interleaved = append(interleaved, speakers[76561198000000001][index], speakers[76561198000000002][index])
+	}
+
+	decode := newSegmentDecoder(msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_OPUS, common.ConcealmentOff)
+	decodedPerSpeaker := make(map[uint64][][]float32)
+	for index, samples := range decodeSegments(t, decode, interleaved) {
+		steamID := interleaved[index].SteamID
+		decodedPerSpeaker[steamID] = append(decodedPerSpeaker[steamID], samples)
+	}
+
+	for steamID, segments := range speakers {
+		speakerDecode, err := newSpeakerDecoder(msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_OPUS, common.ConcealmentOff)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := decodeSegments(t, speakerDecode, segments)
+		for index := range expected {
+			if len(expected[index]) == 0 {
+				t.Fatalf("speaker %d packet %d: no samples decoded", steamID, index)
+			}
+			if !slices.Equal(decodedPerSpeaker[steamID][index], expected[index]) {
+				t.Fatalf("speaker %d packet %d: interleaved decoding differs from decoding the speaker alone", steamID, index)
+			}
+		}
+	}
+}
+
+func TestVoiceCodecDecodersShareTheSpeakerState(t *testing.T) {
+	segments := encodeSpeaker(t, 76561198000000001, 440, 20)
+	codec := newVoiceCodec(msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_OPUS, common.ConcealmentOff)
+	// 1 decoder per output, i.e. the alive and dead files of the speaker
+	aliveDecode, err := codec.NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadDecode, err := codec.NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	speakerDecode, err := newSpeakerDecoder(msgs2.VoiceDataFormatT_VOICEDATA_FORMAT_OPUS, common.ConcealmentOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := decodeSegments(t, speakerDecode, segments)
+	for index, segment := range segments {
+		decode := aliveDecode
+		if index%3 == 0 {
+			decode = deadDecode
+		}
+
+		samples, err := decode(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(samples, expected[index]) {
+			t.Fatalf("packet %d: decoding with several outputs differs from decoding the speaker alone", index)
+		}
+	}
+}
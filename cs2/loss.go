@@ -0,0 +1,70 @@
+package cs2
+
+import (
+	"math"
+
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/msgs2"
+)
+
+type voiceSequence struct {
+	sectionNumber uint32
+	sequenceBytes int32
+	length        int
+	packetCount   int
+}
+
+// packetLossTracker detects the voice packets lost by each speaker. The section number changes every time a player
+// starts talking and the sequence bytes count the bytes of voice data sent in the section before a message, a gap in
+// the sequence bytes means that packets have been lost. A message may contain several packets.
+type packetLossTracker struct {
+	sequences map[uint64]voiceSequence
+}
+
+func newPacketLossTracker() *packetLossTracker {
+	return &packetLossTracker{
+		sequences: make(map[uint64]voiceSequence),
+	}
+}
+
+// isLate returns true when the current message belongs to a previous section or doesn't advance the sequence of its
+// section. Section numbers and sequence bytes are compared with serial number arithmetic so that they can wrap
+// around. The sequence bytes are 0 for every message when the sender doesn't fill them.
+func isLate(previous voiceSequence, current voiceSequence) bool {
+	if current.sectionNumber != previous.sectionNumber {
+		return int32(current.sectionNumber-previous.sectionNumber) < 0
+	}
+
+	return current.sequenceBytes-previous.sequenceBytes < 0 || (current.sequenceBytes == previous.sequenceBytes && current.sequenceBytes != 0)
+}
+
+// track returns the number of packets of the speaker lost right before the message and whether the message has been
+// received after the following messages of its section, or a second time.
+func (tracker *packetLossTracker) track(steamID uint64, audio *msgs2.CMsgVoiceAudio) (int, bool) {
+	current := voiceSequence{
+		sectionNumber: audio.GetSectionNumber(),
+		sequenceBytes: audio.GetSequenceBytes(),
+		length:        len(audio.GetVoiceData()),
+		packetCount:   max(1, int(audio.GetNumPackets())),
+	}
+	previous, hasPrevious := tracker.sequences[steamID]
+	if hasPrevious && isLate(previous, current) {
+		return 0, true
+	}
+	tracker.sequences[steamID] = current
+
+	if !hasPrevious || previous.sectionNumber != current.sectionNumber || previous.length == 0 {
+		return 0, false
+	}
+
+	// the sequence bytes of a message is the number of bytes sent in the section before it, the int32 difference
+	// wraps around like the sequence bytes
+	lostBytes := int(current.sequenceBytes-previous.sequenceBytes) - previous.length
+	if lostBytes <= 0 {
+		return 0, false
+	}
+
+	// packets have about the same size within a section
+	packetLength := float64(previous.length) / float64(previous.packetCount)
+
+	return max(1, int(math.Round(float64(lostBytes)/packetLength))), false
+}
@@ -0,0 +1,159 @@
+package cs2
+
+import (
+	"math"
+	"testing"
+
+	"github.com/akiver/csgo-voice-extractor/common"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/msgs2"
+	"google.golang.org/protobuf/proto"
+)
+
+type trackedMessage struct {
+	steamID       uint64
+	sectionNumber uint32
+	sequenceBytes int32
+	length        int
+	numPackets    uint32
+	expectedLost  int
+	expectedLate  bool
+}
+
+func TestPacketLossTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []trackedMessage
+	}{
+		{"consecutive messages", []trackedMessage{
+			{1, 1, 0, 100, 1, 0, false},
+			{1, 1, 100, 100, 1, 0, false},
+			{1, 1, 200, 80, 1, 0, false},
+		}},
+		{"sequence gap", []trackedMessage{
+			{1, 1, 0, 100, 1, 0, false},
+			{1, 1, 300, 100, 1, 2, false},
+			{1, 1, 450, 100, 1, 1, false},
+		}},
+		{"several packets per message", []trackedMessage{
+			{1, 1, 0, 200, 2, 0, false},
+			{1, 1, 600, 200, 2, 4, false},
+		}},
+		{"section reset", []trackedMessage{
+			{1, 1, 0, 100, 1, 0, false},
+			{1, 1, 100, 100, 1, 0, false},
+			{1, 2, 0, 100, 1, 0, false},
+			{1, 3, 500, 100, 1, 0, false},
+		}},
+		{"late message", []trackedMessage{
+			{1, 1, 0, 100, 1, 0, false},
+			{1, 1, 200, 100, 1, 1, false},
+			{1, 1, 100, 100, 1, 0, true},
+			{1, 1, 300, 100, 1, 0, false},
+		}},
+		{"message of a previous section", []trackedMessage{
+			{1, 2, 0, 100, 1, 0, false},
+			{1, 1, 100, 100, 1, 0, true},
+		}},
+		{"duplicated message", []trackedMessage{
+			{1, 1, 0, 100, 1, 0, false},
+			{1, 1, 100, 100, 1, 0, false},
+			{1, 1, 100, 100, 1, 0, true},
+		}},
+		{"sequence bytes not filled", []trackedMessage{
+			{1, 1, 0, 100, 1, 0, false},
+			{1, 1, 0, 100, 1, 0, false},
+		}},
+		{"section number wraparound", []trackedMessage{
+			{1, math.MaxUint32, 0, 100, 1, 0, false},
+			{1, 0, 0, 100, 1, 0, false},
+			{1, math.MaxUint32, 100, 100, 1, 0, true},
+		}},
+		{"sequence bytes wraparound", []trackedMessage{
+			{1, 1, math.MaxInt32 - 99, 100, 1, 0, false},
+			{1, 1, math.MinInt32, 100, 1, 0, false},
+			{1, 1, math.MinInt32 + 300, 100, 1, 2, false},
+			{1, 1, math.MaxInt32 - 99, 100, 1, 0, true},
+		}},
+		{"speakers tracked separately", []trackedMessage{
+			{1, 1, 0, 100, 1, 0, false},
+			{2, 7, 0, 50, 1, 0, false},
+			{1, 1, 100, 100, 1, 0, false},
+			{2, 7, 100, 50, 1, 1, false},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newPacketLossTracker()
+			for index, message := range test.messages {
+				lost, isLate := tracker.track(message.steamID, &msgs2.CMsgVoiceAudio{
+					VoiceData:     make([]byte, message.length),
+					SectionNumber: proto.Uint32(message.sectionNumber),
+					SequenceBytes: proto.Int32(message.sequenceBytes),
+					NumPackets:    proto.Uint32(message.numPackets),
+				})
+				if lost != message.expectedLost || isLate != message.expectedLate {
+					t.Fatalf("message %d: got %d lost and late %t, want %d lost and late %t", index, lost, isLate, message.expectedLost, message.expectedLate)
+				}
+			}
+		})
+	}
+}
+
+func TestConcealLoss(t *testing.T) {
+	packet := opusSilencePacket
+	tests := []struct {
+		name                     string
+		concealment              common.PacketLossConcealment
+		lostPackets              int
+		expectedConcealedPackets int
+	}{
+		{"concealment disabled", common.ConcealmentOff, 3, 0},
+		{"no lost packets", common.ConcealmentPLC, 0, 0},
+		{"plc", common.ConcealmentPLC, 3, 3},
+		{"fec", common.ConcealmentFEC, 3, 3},
+		{"long gap", common.ConcealmentPLC, 50, maxConcealedPackets},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoder, err := NewOpusDecoder(opusSampleRate, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = Decode(decoder, packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// lost packets last as long as the previous one
+			frameSize, err := decoder.LastPacketDuration()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			samples, err := ConcealLoss(decoder, packet, test.lostPackets, test.concealment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(samples) != test.expectedConcealedPackets*frameSize {
+				t.Fatalf("got %d samples, want %d packets of %d samples", len(samples), test.expectedConcealedPackets, frameSize)
+			}
+		})
+	}
+}
+
+func TestConcealLossWithoutPreviousPacket(t *testing.T) {
+	decoder, err := NewOpusDecoder(opusSampleRate, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples, err := ConcealLoss(decoder, opusSilencePacket, 2, common.ConcealmentPLC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 0 {
+		t.Fatalf("got %d samples, want none because the packet duration is unknown", len(samples))
+	}
+}
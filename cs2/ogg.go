@@ -0,0 +1,264 @@
+package cs2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+const (
+	oggHeaderTypeBOS   = 0x02
+	oggHeaderTypeEOS   = 0x04
+	oggMaxPageSegments = 255
+	oggMaxPagePackets  = 50 // 1 second of 20ms packets, keeps pages small enough for seeking
+	oggOpusVendor      = "csgo-voice-extractor"
+	// Samples per channel of opusSilencePacket, the Ogg Opus granule position is always expressed at 48kHz.
+	opusSilenceSamples = 960
+)
+
+var (
+	ErrInvalidOpusPacket = errors.New("invalid Opus packet")
+	// 20ms CELT fullband mono frame that decodes to digital silence.
+	opusSilencePacket = []byte{0xF8, 0xFF, 0xFE}
+	oggCRCTable       = buildOggCRCTable()
+)
+
+func buildOggCRCTable() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+
+	return table
+}
+
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+
+	return crc
+}
+
+// GetOpusPacketSampleCount returns the number of samples at 48kHz contained in an Opus packet using its TOC byte, see
+// RFC 6716 section 3.1.
+func GetOpusPacketSampleCount(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, ErrInvalidOpusPacket
+	}
+
+	toc := packet[0]
+	config := int(toc >> 3)
+	var frameSize int
+	switch {
+	case config < 12: // SILK: 10, 20, 40 or 60ms
+		frameSize = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid: 10 or 20ms
+		frameSize = []int{480, 960}[config%2]
+	default: // CELT: 2.5, 5, 10 or 20ms
+		frameSize = []int{120, 240, 480, 960}[config%4]
+	}
+
+	var frameCount int
+	switch toc & 0x3 {
+	case 0:
+		frameCount = 1
+	case 1, 2:
+		frameCount = 2
+	default:
+		if len(packet) < 2 {
+			return 0, ErrInvalidOpusPacket
+		}
+		frameCount = int(packet[1] & 0x3F)
+	}
+
+	samples := frameSize * frameCount
+	// a packet can't contain more than 120ms of audio
+	if frameCount == 0 || samples > 5760 {
+		return 0, fmt.Errorf("%w (%d frames of %d samples)", ErrInvalidOpusPacket, frameCount, frameSize)
+	}
+
+	return samples, nil
+}
+
+// SplitOpusPackets returns the Opus packets contained in the voice data of a message. A message may carry several
+// packets, the packet offsets are the positions in the voice data where the packets start or end.
+func SplitOpusPackets(data []byte, offsets []uint32) [][]byte {
+	boundaries := make([]int, 0, len(offsets))
+	for _, offset := range offsets {
+		if offset > 0 && int(offset) < len(data) {
+			boundaries = append(boundaries, int(offset))
+		}
+	}
+	slices.Sort(boundaries)
+	boundaries = slices.Compact(boundaries)
+
+	packets := make([][]byte, 0, len(boundaries)+1)
+	start := 0
+	for _, boundary := range boundaries {
+		packets = append(packets, data[start:boundary])
+		start = boundary
+	}
+
+	return append(packets, data[start:])
+}
+
+// OggOpusWriter muxes Opus packets into an Ogg Opus stream (RFC 7845) without decoding them.
+type OggOpusWriter struct {
+	writer         io.Writer
+	serial         uint32
+	sequence       uint32
+	granule        int64 // position at 48kHz after the last written packet
+	pagePackets    [][]byte
+	pageSegments   int
+	headersWritten bool
+}
+
+func NewOggOpusWriter(writer io.Writer, serial uint32) *OggOpusWriter {
+	return &OggOpusWriter{
+		writer: writer,
+		serial: serial,
+	}
+}
+
+// Granule returns the position in samples at 48kHz after the last written packet.
+func (w *OggOpusWriter) Granule() int64 {
+	return w.granule
+}
+
+func (w *OggOpusWriter) writeHeaders() error {
+	head := make([]byte, 0, 19)
+	head = append(head, "OpusHead"...)
+	head = append(head, 1, 1)                            // version, channel count
+	head = binary.LittleEndian.AppendUint16(head, 0)     // pre-skip, packets come from the middle of a stream
+	head = binary.LittleEndian.AppendUint32(head, 48000) // input sample rate
+	head = binary.LittleEndian.AppendUint16(head, 0)     // output gain
+	head = append(head, 0)                               // channel mapping family
+	err := w.writePage([][]byte{head}, 0, oggHeaderTypeBOS)
+	if err != nil {
+		return err
+	}
+
+	tags := make([]byte, 0, 16+len(oggOpusVendor))
+	tags = append(tags, "OpusTags"...)
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(oggOpusVendor)))
+	tags = append(tags, oggOpusVendor...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0) // user comment list length
+
+	w.headersWritten = true
+
+	return w.writePage([][]byte{tags}, 0, 0)
+}
+
+func getPacketSegmentCount(packet []byte) int {
+	return len(packet)/255 + 1
+}
+
+func (w *OggOpusWriter) writePage(packets [][]byte, granule int64, headerType byte) error {
+	lacing := make([]byte, 0, oggMaxPageSegments)
+	bodyLength := 0
+	for _, packet := range packets {
+		for length := len(packet); ; length -= 255 {
+			if length < 255 {
+				lacing = append(lacing, byte(length))
+				break
+			}
+			lacing = append(lacing, 255)
+		}
+		bodyLength += len(packet)
+	}
+
+	page := make([]byte, 0, 27+len(lacing)+bodyLength)
+	page = append(page, "OggS"...)
+	page = append(page, 0, headerType)
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = binary.LittleEndian.AppendUint32(page, w.serial)
+	page = binary.LittleEndian.AppendUint32(page, w.sequence)
+	page = binary.LittleEndian.AppendUint32(page, 0) // CRC, computed once the page is complete
+	page = append(page, byte(len(lacing)))
+	page = append(page, lacing...)
+	for _, packet := range packets {
+		page = append(page, packet...)
+	}
+	binary.LittleEndian.PutUint32(page[22:26], oggCRC(page))
+
+	_, err := w.writer.Write(page)
+	if err != nil {
+		return err
+	}
+	w.sequence++
+
+	return nil
+}
+
+func (w *OggOpusWriter) flushPage(headerType byte) error {
+	if len(w.pagePackets) == 0 && headerType&oggHeaderTypeEOS == 0 {
+		return nil
+	}
+
+	err := w.writePage(w.pagePackets, w.granule, headerType)
+	w.pagePackets = w.pagePackets[:0]
+	w.pageSegments = 0
+
+	return err
+}
+
+// WritePacket adds an Opus packet that contains the given number of samples at 48kHz.
+func (w *OggOpusWriter) WritePacket(packet []byte, samples int) error {
+	if !w.headersWritten {
+		err := w.writeHeaders()
+		if err != nil {
+			return err
+		}
+	}
+
+	segmentCount := getPacketSegmentCount(packet)
+	if w.pageSegments+segmentCount > oggMaxPageSegments || len(w.pagePackets) == oggMaxPagePackets {
+		err := w.flushPage(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.pagePackets = append(w.pagePackets, packet)
+	w.pageSegments += segmentCount
+	w.granule += int64(samples)
+
+	return nil
+}
+
+// WriteSilence adds silent packets until the granule position reaches the given position (at 48kHz). The position is
+// reached with a precision of 20ms.
+func (w *OggOpusWriter) WriteSilence(position int64) error {
+	for position-w.granule >= opusSilenceSamples {
+		err := w.WritePacket(opusSilencePacket, opusSilenceSamples)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close writes the last page with the end of stream flag. It doesn't close the underlying writer.
+func (w *OggOpusWriter) Close() error {
+	if !w.headersWritten {
+		err := w.writeHeaders()
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.flushPage(oggHeaderTypeEOS)
+}
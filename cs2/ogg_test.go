@@ -0,0 +1,32 @@
+package cs2
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitOpusPackets(t *testing.T) {
+	data := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	tests := []struct {
+		name     string
+		offsets  []uint32
+		expected [][]byte
+	}{
+		{"no offsets", nil, [][]byte{data}},
+		{"single packet start", []uint32{0}, [][]byte{data}},
+		{"single packet end", []uint32{10}, [][]byte{data}},
+		{"start offsets", []uint32{0, 3, 7}, [][]byte{{0, 1, 2}, {3, 4, 5, 6}, {7, 8, 9}}},
+		{"end offsets", []uint32{3, 7, 10}, [][]byte{{0, 1, 2}, {3, 4, 5, 6}, {7, 8, 9}}},
+		{"unsorted and duplicated offsets", []uint32{7, 3, 3}, [][]byte{{0, 1, 2}, {3, 4, 5, 6}, {7, 8, 9}}},
+		{"offset out of the voice data", []uint32{5, 42}, [][]byte{{0, 1, 2, 3, 4}, {5, 6, 7, 8, 9}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packets := SplitOpusPackets(data, test.offsets)
+			if !slices.EqualFunc(packets, test.expected, slices.Equal) {
+				t.Fatalf("got %v, want %v", packets, test.expected)
+			}
+		})
+	}
+}
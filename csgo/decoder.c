@@ -5,7 +5,11 @@
 
 void *handle;
 CeltDecodeFunc* celtDecode;
-CELTDecoder *decoder;
+CeltDecoderCreateCustomFunc* celtDecoderCreateCustom;
+// the destroy functions are optional, decoders and the mode are not freed if the lib doesn't export them
+CeltDecoderDestroyFunc* celtDecoderDestroy;
+CeltModeDestroyFunc* celtModeDestroy;
+CELTMode *mode;
 
 int Init(const char *csgoLibPath) {
     // The CSGO audio lib depends on an additional lib "tier0" which is not located on standard paths but in the CSGO folder.
@@ -32,7 +36,7 @@ int Init(const char *csgoLibPath) {
         return EXIT_FAILURE;
     }
 
-    CeltDecoderCreateCustomFunc* celtDecoderCreateCustom = dlsym(handle, "celt_decoder_create_custom");
+    celtDecoderCreateCustom = dlsym(handle, "celt_decoder_create_custom");
     if (celtDecoderCreateCustom == NULL) {
         fprintf(stderr, "dlsym celt_decoder_create_custom failed: %s\n", dlerror());
         Release();
@@ -46,25 +50,36 @@ int Init(const char *csgoLibPath) {
         return EXIT_FAILURE;
     }
 
-    CELTMode *mode = celtModeCreate(SAMPLE_RATE, FRAME_SIZE, NULL);
+    celtDecoderDestroy = dlsym(handle, "celt_decoder_destroy");
+    celtModeDestroy = dlsym(handle, "celt_mode_destroy");
+
+    mode = celtModeCreate(SAMPLE_RATE, FRAME_SIZE, NULL);
     if (mode == NULL) {
         fprintf(stderr, "Mode creation failed\n");
         Release();
         return EXIT_FAILURE;
     }
 
-    decoder = celtDecoderCreateCustom(mode, 1, NULL);
-    if (decoder == NULL) {
-        fprintf(stderr, "Decoder creation failed\n");
-        Release();
-        return EXIT_FAILURE;
-    }
-
     return EXIT_SUCCESS;
 }
 
+// Release frees the mode and unloads the lib, the decoders must have been destroyed before.
 int Release() {
+    if (mode != NULL && celtModeDestroy != NULL) {
+        celtModeDestroy(mode);
+    }
+    mode = NULL;
+    celtDecode = NULL;
+    celtDecoderCreateCustom = NULL;
+    celtDecoderDestroy = NULL;
+    celtModeDestroy = NULL;
+
+    if (handle == NULL) {
+        return EXIT_SUCCESS;
+    }
+
     int closed = dlclose(handle);
+    handle = NULL;
     if (closed != 0) {
         fprintf(stderr, "Release failed: %s\n", dlerror());
         return EXIT_FAILURE;
@@ -73,21 +88,41 @@ int Release() {
     return EXIT_SUCCESS;
 }
 
+// CreateDecoder returns a new decoder, each speaker needs its own decoder because CELT keeps state between frames.
+CELTDecoder *CreateDecoder() {
+    if (mode == NULL) {
+        return NULL;
+    }
+
+    CELTDecoder *decoder = celtDecoderCreateCustom(mode, 1, NULL);
+    if (decoder == NULL) {
+        fprintf(stderr, "Decoder creation failed\n");
+    }
+
+    return decoder;
+}
 
-int Decode(int dataSize, unsigned char *data, char *pcmOut, int maxPcmBytes) {
-    size_t outputSize = (dataSize / PACKET_SIZE) * FRAME_SIZE * 2;
-    if (outputSize > (size_t)maxPcmBytes) {
-        outputSize = maxPcmBytes;
+void DestroyDecoder(CELTDecoder *decoder) {
+    if (decoder != NULL && celtDecoderDestroy != NULL) {
+        celtDecoderDestroy(decoder);
     }
+}
+
+// Decode decodes the frames of a voice packet and returns the number of bytes written, frames that can't be decoded
+// are replaced by silence and counted in failedFrames.
+int Decode(CELTDecoder *decoder, int dataSize, unsigned char *data, char *pcmOut, int maxPcmBytes, int *failedFrames) {
     int16_t* output = (int16_t*)pcmOut;
 
     int read = 0;
     int written = 0;
+    *failedFrames = 0;
 
     while (read < dataSize && (written + FRAME_SIZE * 2) <= maxPcmBytes) {
-        int result = celtDecode(decoder, data + read, PACKET_SIZE, output + (written / 2), FRAME_SIZE);
+        int packetSize = dataSize - read < PACKET_SIZE ? dataSize - read : PACKET_SIZE;
+        int result = celtDecode(decoder, data + read, packetSize, output + (written / 2), FRAME_SIZE);
         if (result < 0) {
-            continue;
+            memset(output + (written / 2), 0, FRAME_SIZE * 2);
+            (*failedFrames)++;
         }
 
         read += PACKET_SIZE;
@@ -22,10 +22,14 @@ typedef struct CELTDecoder CELTDecoder;
 typedef struct CELTEncoder CELTEncoder;
 typedef CELTMode* CeltModeCreateFunc(int32_t, int, int *error);
 typedef CELTDecoder* CeltDecoderCreateCustomFunc(CELTMode*, int, int *error);
+typedef void CeltDecoderDestroyFunc(CELTDecoder *st);
+typedef void CeltModeDestroyFunc(CELTMode *mode);
 typedef int CeltDecodeFunc(CELTDecoder *st, const unsigned char *data, int len, int16_t *pcm, int frame_size);
 
 int Init(const char *binariesPath);
 int Release();
-int Decode(int dataSize, unsigned char *data, char *pcmOut, int maxPcmBytes);
+CELTDecoder *CreateDecoder();
+void DestroyDecoder(CELTDecoder *decoder);
+int Decode(CELTDecoder *decoder, int dataSize, unsigned char *data, char *pcmOut, int maxPcmBytes, int *failedFrames);
 
 #endif
@@ -5,21 +5,20 @@ package csgo
 // #include "decoder.h"
 import "C"
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math"
-	"os"
-	"path/filepath"
 	"slices"
-	"strings"
+	"sync"
 	"unsafe"
 
 	"github.com/akiver/csgo-voice-extractor/common"
-	"github.com/go-audio/audio"
-	goWav "github.com/go-audio/wav"
 	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/events"
 	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/msg"
-	"github.com/youpy/go-wav"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -30,28 +29,50 @@ const (
 	FrameSize      = 512 // number of samples per frame after decoding
 )
 
-func createTempFile(prefix string) (string, error) {
-	tmpFile, err := os.CreateTemp("", prefix)
-	if err != nil {
-		common.HandleError(common.Error{
-			Message:  fmt.Sprintf("Failed to create temporary file: %s", err),
-			ExitCode: common.DecodingError,
-		})
-		return "", err
-	}
+var extractMutex sync.Mutex
 
-	filePath := tmpFile.Name()
-	tmpFile.Close()
+var audioFormat = common.AudioFormat{
+	SampleRate:  SampleRate,
+	NumChannels: 1,
+	BitDepth:    16,
+}
+
+// pcmToInts converts 16-bit little-endian PCM bytes to samples.
+func pcmToInts(pcm []byte) []int {
+	numSamples := len(pcm) / BytesPerSample
+	samples := make([]int, numSamples)
+	for i := 0; i < numSamples; i++ {
+		samples[i] = int(int16(uint16(pcm[i*2]) | uint16(pcm[i*2+1])<<8))
+	}
 
-	return filePath, nil
+	return samples
 }
 
-func buildPlayerWavFilePath(playerID string, demoName string, outputPath string) string {
-	return filepath.Join(outputPath, fmt.Sprintf("%s_%s.wav", demoName, playerID))
+type parsingResult struct {
+	segmentsPerPlayer map[string][]common.VoiceSegment
+	players           map[string]common.Player
+	durationSeconds   float64
+	clock             *common.Clock
+	rounds            []common.Round
+	events            []common.GameEvent
+	window            *common.TimeWindow
+	periods           []common.Period
+	hasWindowEnded    bool // the parsing has been canceled at the end of the window
+	unsupportedCodec  *common.UnsupportedCodec
+	voiceStream       *common.VoiceStream // set when voices have been written while the demo was parsed
+	streamErr         error
 }
 
-func getSegments(file *os.File, steamIDs []string) (map[string][]common.VoiceSegment, float64, error) {
+func getSegments(ctx context.Context, reader io.Reader, codec common.VoiceCodec, options common.ExtractOptions) (parsingResult, error) {
 	var segments = map[string][]common.VoiceSegment{}
+	var players = map[string]common.Player{}
+	var unsupportedCodec *common.UnsupportedCodec
+	// with the split-compact, split-full and single-full modes, voices are written while the demo is parsed
+	var voiceStream *common.VoiceStream
+	var streamErr error
+	if options.CanStreamVoices() {
+		voiceStream = common.NewVoiceStream(codec, options)
+	}
 
 	parserConfig := dem.DefaultParserConfig
 	parserConfig.AdditionalNetMessageCreators = map[int]dem.NetMessageCreator{
@@ -61,14 +82,32 @@ func getSegments(file *os.File, steamIDs []string) (map[string][]common.VoiceSeg
 		int(msg.SVC_Messages_svc_VoiceInit): func() proto.Message {
 			return new(msg.CSVCMsg_VoiceInit)
 		},
+		int(msg.NET_Messages_net_Tick): func() proto.Message {
+			return new(msg.CNETMsg_Tick)
+		},
 	}
 
-	parser := dem.NewParserWithConfig(file, parserConfig)
+	parser := dem.NewParserWithConfig(reader, parserConfig)
 	defer parser.Close()
 
+	parser.RegisterEventHandler(func(events.FrameDone) {
+		if ctx.Err() != nil {
+			parser.Cancel()
+		}
+	})
+
+	playerNames := common.NewPlayerNameCache()
+	clock := common.NewClock(parser, options.Timebase)
+	roundTracker := common.NewRoundTracker(parser, clock)
+	eventTracker := common.NewEventTracker(parser, clock)
+	teamTracker := common.NewTeamTracker(parser)
+	povTracker := common.NewPOVTracker(parser, options)
+	timeWindowTracker := common.NewTimeWindowTracker(parser, clock, roundTracker, options)
+	periodTracker := common.NewPeriodTracker(parser, clock, options)
+
 	parser.RegisterNetMessageHandler(func(m *msg.CSVCMsg_VoiceInit) {
 		if m.GetCodec() != "vaudio_celt" || m.GetQuality() != 5 || m.GetVersion() != 3 {
-			common.UnsupportedCodecError = &common.UnsupportedCodec{
+			unsupportedCodec = &common.UnsupportedCodec{
 				Name:    m.GetCodec(),
 				Quality: m.GetQuality(),
 				Version: m.GetVersion(),
@@ -78,34 +117,87 @@ func getSegments(file *os.File, steamIDs []string) (map[string][]common.VoiceSeg
 	})
 
 	parser.RegisterNetMessageHandler(func(m *msg.CSVCMsg_VoiceData) {
+		if streamErr != nil {
+			return
+		}
+
 		steamID := m.GetXuid()
-		if len(steamIDs) > 0 && !slices.Contains(steamIDs, fmt.Sprintf("%d", steamID)) {
+		if len(options.SteamIDs) > 0 && !slices.Contains(options.SteamIDs, fmt.Sprintf("%d", steamID)) {
 			return
 		}
 
-		playerID := common.GetPlayerID(parser, steamID)
+		playerID := playerNames.GetPlayerID(parser, steamID)
 		if playerID == "" {
+			options.Logf("Unable to find player's name with SteamID %d\n", steamID)
 			return
 		}
 
 		if segments[playerID] == nil {
 			segments[playerID] = make([]common.VoiceSegment, 0)
+			players[playerID] = common.Player{
+				SteamID: steamID,
+				Name:    playerNames.GetPlayerName(parser, steamID),
+				ID:      playerID,
+			}
 		}
-		segments[playerID] = append(segments[playerID], common.VoiceSegment{
-			Data:      m.GetVoiceData(),
-			Timestamp: parser.CurrentTime().Seconds(),
-		})
+
+		side, teamName := teamTracker.GetPlayerTeam(steamID)
+		segment := common.VoiceSegment{
+			Data:       m.GetVoiceData(),
+			Timestamp:  clock.Seconds(),
+			Tick:       clock.Tick(),
+			ServerTick: clock.ServerTick(),
+			DemoTick:   clock.DemoTick(),
+			IsAlive:    common.IsPlayerAlive(parser, steamID),
+			Side:       side,
+			TeamName:   teamName,
+			SteamID:    steamID,
+			PlayerID:   playerID,
+			Index:      len(segments[playerID]),
+			Spatial:    povTracker.GetSpatialPosition(steamID),
+		}
+
+		if voiceStream != nil {
+			streamErr = voiceStream.Write(segment, players[playerID])
+			if streamErr != nil {
+				parser.Cancel()
+				return
+			}
+			// the voice data has been written, only the metadata is kept for the sidecar files
+			segment.Data = nil
+		}
+		segments[playerID] = append(segments[playerID], segment)
 	})
 
 	err := parser.ParseToEnd()
-	durationSeconds := parser.CurrentTime().Seconds()
+	durationSeconds := clock.Seconds()
+	rounds := roundTracker.Rounds(durationSeconds)
+	window, windowErr := timeWindowTracker.Window(durationSeconds)
+	if windowErr != nil {
+		err = windowErr
+	}
 
-	return segments, durationSeconds, err
+	return parsingResult{
+		segmentsPerPlayer: segments,
+		players:           players,
+		durationSeconds:   durationSeconds,
+		clock:             clock,
+		rounds:            rounds,
+		events:            eventTracker.Events(rounds),
+		window:            window,
+		periods:           periodTracker.Periods(durationSeconds),
+		hasWindowEnded:    timeWindowTracker.HasEnded(),
+		unsupportedCodec:  unsupportedCodec,
+		voiceStream:       voiceStream,
+		streamErr:         streamErr,
+	}, err
 }
 
-func decodeVoiceData(data []byte) ([]byte, bool) {
+// decodeVoiceData decodes the frames of a voice packet with the speaker's decoder, it returns the PCM bytes and the
+// number of frames that couldn't be decoded and have been replaced by silence.
+func decodeVoiceData(decoder *C.CELTDecoder, data []byte) ([]byte, int) {
 	if len(data) == 0 {
-		return nil, false
+		return nil, 0
 	}
 
 	outputSamples := (len(data) / PacketSize) * FrameSize
@@ -119,357 +211,472 @@ func decodeVoiceData(data []byte) ([]byte, bool) {
 	cDataSize := C.int(len(data))
 	cPcm := (*C.char)(unsafe.Pointer(&pcm[0]))
 	cPcmSize := C.int(outputSize)
+	var cFailedFrames C.int
 
-	written := C.Decode(cDataSize, cData, cPcm, cPcmSize)
+	written := C.Decode(decoder, cDataSize, cData, cPcm, cPcmSize, &cFailedFrames)
 	if written <= 0 {
-		return nil, false
+		return nil, int(cFailedFrames)
+	}
+
+	return pcm[:written], int(cFailedFrames)
+}
+
+// decoderPool creates the CELT decoders of an extraction, 1 per speaker because CELT keeps state between frames. The
+// decoder of a speaker is shared by all the outputs, so that a voice split in several files, i.e. alive and dead, is
+// decoded with a single state. Decoders are destroyed by release at the end of the extraction.
+type decoderPool struct {
+	options  common.ExtractOptions
+	decoders map[uint64]*C.CELTDecoder // per SteamID
+}
+
+func newDecoderPool(options common.ExtractOptions) *decoderPool {
+	return &decoderPool{
+		options:  options,
+		decoders: make(map[uint64]*C.CELTDecoder),
+	}
+}
+
+func (pool *decoderPool) getDecoder(steamID uint64) (*C.CELTDecoder, error) {
+	decoder := pool.decoders[steamID]
+	if decoder == nil {
+		decoder = C.CreateDecoder()
+		if decoder == nil {
+			return nil, common.NewError("Failed to create CSGO audio decoder", nil, common.LoadCsgoLibError)
+		}
+		pool.decoders[steamID] = decoder
 	}
 
-	return pcm[:written], true
+	return decoder, nil
 }
 
-func generateAudioFileWithMergedVoices(segmentsPerPlayer map[string][]common.VoiceSegment, durationSeconds float64, demoName string, outputPath string) {
-	wavFilePath := filepath.Join(outputPath, demoName+".wav")
-	wavFile, err := common.CreateWavFile(wavFilePath)
+// decode returns the samples of a voice segment as floats holding 16-bit values.
+func (pool *decoderPool) decode(segment common.VoiceSegment) ([]float32, error) {
+	decoder, err := pool.getDecoder(segment.SteamID)
 	if err != nil {
-		return
+		return nil, err
+	}
+
+	pcm, failedFrames := decodeVoiceData(decoder, segment.Data)
+	if len(pcm) == 0 {
+		return nil, errors.New("Failed to decode voice data")
+	}
+
+	if failedFrames > 0 {
+		pool.options.Logf("Failed to decode %d of %d frames of the voice segment at %f seconds\n", failedFrames, len(pcm)/BytesPerSample/FrameSize, segment.Timestamp)
+	}
+
+	samples := make([]float32, len(pcm)/BytesPerSample)
+	for i, sample := range pcmToInts(pcm) {
+		samples[i] = float32(sample)
+	}
+
+	return samples, nil
+}
+
+func (pool *decoderPool) newSegmentDecoder() (common.SegmentDecoder, error) {
+	return pool.decode, nil
+}
+
+func (pool *decoderPool) release() {
+	for steamID, decoder := range pool.decoders {
+		C.DestroyDecoder(decoder)
+		delete(pool.decoders, steamID)
+	}
+}
+
+func samplesToInts(samples []float32) []int {
+	ints := make([]int, len(samples))
+	for i, sample := range samples {
+		ints[i] = int(sample)
+	}
+
+	return ints
+}
+
+// mixChunk mixes the segments that overlap with the chunk [chunkStart, chunkEnd[ and returns its interleaved samples.
+func mixChunk(voiceSegments []common.MixedSegment, chunkStart int, chunkEnd int, numChannels int) []int {
+	chunkLength := chunkEnd - chunkStart
+	// interleaved samples
+	mixedChunk := make([]int32, chunkLength*numChannels)
+	activeSources := make([]int, chunkLength*numChannels)
+
+	// find segments that overlap with the current chunk
+	for _, segment := range voiceSegments {
+		segmentEnd := segment.End()
+		// check if this segment does not overlap with the current chunk
+		if segmentEnd <= chunkStart || segment.Position >= chunkEnd {
+			continue
+		}
+
+		// calculate the start and end of the overlap
+		overlapStart := segment.Position
+		if overlapStart < chunkStart {
+			overlapStart = chunkStart
+		}
+		overlapEnd := segmentEnd
+		if overlapEnd > chunkEnd {
+			overlapEnd = chunkEnd
+		}
+
+		// add samples in the chunk and track active sources (players talking at the same time)
+		for i := overlapStart; i < overlapEnd; i++ {
+			sampleIndex := i - chunkStart
+			sampleStartPosition := i - segment.Position
+
+			if sampleStartPosition >= 0 && sampleStartPosition < len(segment.Samples) {
+				sample := int32(segment.Samples[sampleStartPosition])
+				if sample != 0 { // ignore silence
+					for channel, gain := range segment.Gains {
+						if gain == 0 {
+							continue
+						}
+						mixedChunk[sampleIndex*numChannels+channel] += int32(float64(sample) * gain)
+						activeSources[sampleIndex*numChannels+channel]++
+					}
+				}
+			}
+		}
+	}
+
+	// normalize and mix samples in the chunk
+	chunkSamples := make([]int, len(mixedChunk))
+	for i, sample := range mixedChunk {
+		if sample == 0 || activeSources[i] == 0 {
+			// silence
+			continue
+		}
+
+		// normalize the sample if several players are talking at the same time
+		mixCoefficient := 1.0
+		if activeSources[i] > 1 {
+			mixCoefficient = 1.0 / math.Sqrt(float64(activeSources[i]))
+		}
+
+		mixedSample := float64(sample) * mixCoefficient
+		// clip to int16 range because WAV format requires 16-bit samples
+		if mixedSample > math.MaxInt16 {
+			mixedSample = math.MaxInt16
+		} else if mixedSample < -math.MaxInt16 {
+			mixedSample = -math.MaxInt16
+		}
+
+		chunkSamples[i] = int(int16(mixedSample))
+	}
+
+	return chunkSamples
+}
+
+func newVoiceCodec(decoders *decoderPool) common.VoiceCodec {
+	return common.VoiceCodec{
+		Format:     audioFormat,
+		NewDecoder: decoders.newSegmentDecoder,
+		ToInts:     samplesToInts,
+		MixChunk:   mixChunk,
 	}
-	defer wavFile.Close()
+}
 
+func generateAudioFileWithMergedVoices(segmentsPerPlayer map[string][]common.VoiceSegment, codec common.VoiceCodec, durationSeconds float64, options common.ExtractOptions) ([]string, error) {
 	totalSamples := int(durationSeconds * float64(SampleRate))
-	var numChannels uint16 = 1
-	var bitsPerSample uint16 = 16
-	writer := wav.NewWriter(wavFile, uint32(totalSamples), numChannels, SampleRate, bitsPerSample)
+	numChannels := options.GetMergedChannelCount()
+	mergedAudioFormat := audioFormat
+	mergedAudioFormat.NumChannels = numChannels
 
-	type VoiceSegmentInfo struct {
-		StartPosition int
-		Data          []byte
-		Length        int
+	voiceSegments := make([]common.MixedSegment, 0)
+	decode, err := codec.NewDecoder()
+	if err != nil {
+		return nil, err
 	}
 
-	voiceSegments := make([]VoiceSegmentInfo, 0)
 	for _, segments := range segmentsPerPlayer {
 		var previousEndPosition = 0
 		for _, segment := range segments {
-			startSample := int(segment.Timestamp * float64(SampleRate))
-			startPosition := startSample * BytesPerSample
-
+			startPosition := int(segment.Timestamp * float64(SampleRate))
 			if startPosition < previousEndPosition {
 				startPosition = previousEndPosition
 			}
 
-			if startPosition >= totalSamples*BytesPerSample {
-				fmt.Printf("Warning: Voice segment at %f seconds exceeds demo duration\n", segment.Timestamp)
+			if startPosition >= totalSamples {
+				options.Logf("Warning: Voice segment at %f seconds exceeds demo duration\n", segment.Timestamp)
 				continue
 			}
 
-			samples, ok := decodeVoiceData(segment.Data)
-			if !ok {
-				common.HandleError(common.NewDecodingError("Failed to decode voice data", nil))
+			samples, err := decode(segment)
+			if err != nil {
+				options.Logf("%s\n", err)
 				continue
 			}
 
-			voiceSegments = append(voiceSegments, VoiceSegmentInfo{
-				StartPosition: startPosition,
-				Data:          samples,
-				Length:        len(samples),
+			voiceSegments = append(voiceSegments, common.MixedSegment{
+				Segment:  segment,
+				Position: startPosition,
+				Samples:  samples,
+				Gains:    options.GetChannelGains(segment),
 			})
 
 			previousEndPosition = startPosition + len(samples)
 		}
 	}
 
-	// process in small chunks to avoid high memory usage
-	const chunkSize = 8192 * BytesPerSample
-	for chunkStart := 0; chunkStart < totalSamples*BytesPerSample; chunkStart += chunkSize {
-		chunkEnd := chunkStart + chunkSize
-		if chunkEnd > totalSamples*BytesPerSample {
-			chunkEnd = totalSamples * BytesPerSample
-		}
+	sink, err := options.CreateMergedSink(mergedAudioFormat)
+	if err != nil {
+		return nil, err
+	}
 
-		chunkLength := chunkEnd - chunkStart
-		mixedChunk := make([]int32, chunkLength/BytesPerSample)
-		activeSources := make([]int, chunkLength/BytesPerSample)
+	for _, segment := range voiceSegments {
+		options.Placements.Record(segment.Segment, sink, segment.Position, min(len(segment.Samples), totalSamples-segment.Position), SampleRate)
+	}
 
-		// find segments that overlap with the current chunk
-		for _, segment := range voiceSegments {
-			segmentEnd := segment.StartPosition + segment.Length
-			// check if this segment does not overlap with the current chunk
-			if segmentEnd <= chunkStart || segment.StartPosition >= chunkEnd {
-				continue
-			}
+	// process in small chunks to avoid high memory usage
+	err = common.WriteMixedChunks(sink, voiceSegments, totalSamples, mergedAudioFormat, mixChunk)
+	err = common.CloseSink(sink, err)
+	if err != nil {
+		return nil, err
+	}
 
-			// calculate the start and end of the overlap
-			overlapStart := segment.StartPosition
-			if overlapStart < chunkStart {
-				overlapStart = chunkStart
-			}
-			overlapEnd := segmentEnd
-			if overlapEnd > chunkEnd {
-				overlapEnd = chunkEnd
-			}
+	if path := common.GetSinkPath(sink); path != "" {
+		return []string{path}, nil
+	}
 
-			// add samples in the chunk and track active sources (players talking at the same time)
-			for i := overlapStart; i < overlapEnd; i += BytesPerSample {
-				sampleIndex := (i - chunkStart) / BytesPerSample
-				sampleStartPosition := i - segment.StartPosition
+	return nil, nil
+}
 
-				if sampleStartPosition >= 0 && sampleStartPosition < segment.Length-1 {
-					sample := int32(int16(uint16(segment.Data[sampleStartPosition]) | uint16(segment.Data[sampleStartPosition+1])<<8))
-					if sample != 0 { // ignore silence
-						mixedChunk[sampleIndex] += sample
-						activeSources[sampleIndex]++
-					}
-				}
-			}
+// generateClipAudioFiles writes 1 file per utterance without silence.
+func generateClipAudioFiles(segmentsPerPlayer map[string][]common.VoiceSegment, players map[string]common.Player, codec common.VoiceCodec, options common.ExtractOptions) ([]string, error) {
+	utterances := options.GetUtterances(segmentsPerPlayer)
+	files := make([]string, 0, len(utterances))
+	for _, utterance := range utterances {
+		sink, err := options.CreateClipSink(players[utterance.PlayerID], utterance, audioFormat)
+		if err != nil {
+			return files, err
 		}
 
-		// normalize and mix samples in the chunk
-		maxSampleValue := int32(1)
-		chunkBytes := make([]byte, chunkLength)
-		for i, sample := range mixedChunk {
-			if sample == 0 || activeSources[i] == 0 {
-				// write silence
-				chunkBytes[i*BytesPerSample] = 0
-				chunkBytes[i*BytesPerSample+1] = 0
-				continue
-			}
-
-			// normalize the sample if several players are talking at the same time
-			mixCoefficient := 1.0
-			if activeSources[i] > 1 {
-				mixCoefficient = 1.0 / math.Sqrt(float64(activeSources[i]))
-			}
-
-			mixedSample := float64(sample) * mixCoefficient
-			if int32(math.Abs(mixedSample)) > maxSampleValue {
-				maxSampleValue = int32(math.Abs(mixedSample))
-			}
-
-			// clip to int16 range because WAV format requires 16-bit samples
-			if mixedSample > math.MaxInt16 {
-				mixedSample = math.MaxInt16
-			} else if mixedSample < -math.MaxInt16 {
-				mixedSample = -math.MaxInt16
-			}
-
-			// convert back to bytes
-			mixedInt16 := int16(mixedSample)
-			chunkBytes[i*BytesPerSample] = byte(mixedInt16)
-			chunkBytes[i*BytesPerSample+1] = byte(mixedInt16 >> 8)
+		err = writeCompactVoiceSegments(utterance.Segments, codec, sink, options)
+		err = common.CloseSink(sink, err)
+		if err != nil {
+			return files, err
 		}
 
-		_, err = writer.Write(chunkBytes)
-		if err != nil {
-			common.HandleError(common.Error{
-				Message:  "Couldn't write WAV file",
-				Err:      err,
-				ExitCode: common.WavFileCreationError,
-			})
+		if path := common.GetSinkPath(sink); path != "" {
+			files = append(files, path)
 		}
 	}
-}
 
-func generateAudioFilesWithDemoLength(segmentsPerPlayer map[string][]common.VoiceSegment, durationSeconds float64, demoName string, outputPath string) {
-	for playerID, segments := range segmentsPerPlayer {
-		wavFilePath := buildPlayerWavFilePath(playerID, demoName, outputPath)
-		totalSamples := int(durationSeconds * float64(SampleRate))
+	return files, nil
+}
 
-		wavFile, err := common.CreateWavFile(wavFilePath)
-		if err != nil {
-			return
+// generateRoundAudioFiles writes 1 merged file per round and optionally 1 file per player and round.
+func generateRoundAudioFiles(segmentsPerPlayer map[string][]common.VoiceSegment, players map[string]common.Player, codec common.VoiceCodec, rounds []common.Round, durationSeconds float64, options common.ExtractOptions) ([]string, error) {
+	return common.GenerateRoundFiles(segmentsPerPlayer, rounds, durationSeconds, options, func(roundSegments map[string][]common.VoiceSegment, roundDurationSeconds float64, roundOptions common.ExtractOptions) ([]string, error) {
+		files, err := generateAudioFileWithMergedVoices(roundSegments, codec, roundDurationSeconds, roundOptions)
+		if err != nil || !options.SplitRoundsPerPlayer {
+			return files, err
 		}
-		defer wavFile.Close()
 
-		var numChannels uint16 = 1
-		var bitsPerSample uint16 = 16
-		writer := wav.NewWriter(wavFile, uint32(totalSamples), numChannels, SampleRate, bitsPerSample)
+		playerFiles, err := generateAudioFilesWithDemoLength(roundSegments, players, codec, roundDurationSeconds, roundOptions)
 
-		chunkSize := 8192 * BytesPerSample
-		chunkBuffer := make([]byte, chunkSize)
+		return append(files, playerFiles...), err
+	})
+}
 
-		previousEndPosition := 0
-		segmentIndex := 0
-		for position := 0; position < totalSamples*BytesPerSample; position += chunkSize {
-			// clear the chunk buffer
-			for i := range chunkBuffer {
-				chunkBuffer[i] = 0
-			}
+func generateMultitrackAudioFile(segmentsPerPlayer map[string][]common.VoiceSegment, players map[string]common.Player, codec common.VoiceCodec, durationSeconds float64, options common.ExtractOptions) ([]string, error) {
+	totalSamples := int(durationSeconds * float64(SampleRate))
+	sortedPlayers := common.SortPlayers(players, segmentsPerPlayer)
+	tracks := make([][]common.TrackSegment, len(sortedPlayers))
+	for index, player := range sortedPlayers {
+		track, err := decodeTrack(segmentsPerPlayer[player.ID], codec, totalSamples, options)
+		if err != nil {
+			return nil, err
+		}
+		tracks[index] = track
+	}
 
-			currentChunkEnd := position + chunkSize
-			if currentChunkEnd > totalSamples*BytesPerSample {
-				currentChunkEnd = totalSamples * BytesPerSample
-				chunkBuffer = chunkBuffer[:currentChunkEnd-position]
-			}
+	return common.GenerateMultitrackFile(tracks, sortedPlayers, audioFormat, totalSamples, options)
+}
 
-			// find segments that overlap with the current chunk
-			for segmentIndex < len(segments) {
-				segment := segments[segmentIndex]
-				startSample := int(segment.Timestamp * float64(SampleRate))
-				startPosition := startSample * BytesPerSample
+// decodeTrack decodes the player's voice segments and places them at their original timestamps.
+func decodeTrack(segments []common.VoiceSegment, codec common.VoiceCodec, totalSamples int, options common.ExtractOptions) ([]common.TrackSegment, error) {
+	decode, err := codec.NewDecoder()
+	if err != nil {
+		return nil, err
+	}
 
-				if startPosition < previousEndPosition {
-					startPosition = previousEndPosition
-				}
+	track := make([]common.TrackSegment, 0, len(segments))
+	previousEndPosition := 0
+	for _, segment := range segments {
+		startPosition := max(int(segment.Timestamp*float64(SampleRate)), previousEndPosition)
+		if startPosition >= totalSamples {
+			options.Logf("Warning: Voice segment at %f seconds exceeds demo duration\n", segment.Timestamp)
+			continue
+		}
 
-				if startPosition >= currentChunkEnd {
-					break
-				}
+		decodedSamples, err := decode(segment)
+		if err != nil {
+			options.Logf("%s\n", err)
+			continue
+		}
 
-				samples, ok := decodeVoiceData(segment.Data)
-				if !ok {
-					segmentIndex++
-					continue
-				}
+		samples := codec.ToInts(decodedSamples)
+		// truncate the segment if it exceeds the demo duration
+		if startPosition+len(samples) > totalSamples {
+			samples = samples[:totalSamples-startPosition]
+		}
 
-				segmentEnd := startPosition + len(samples)
+		track = append(track, common.TrackSegment{
+			Segment:  segment,
+			Position: startPosition,
+			Samples:  samples,
+		})
+		previousEndPosition = startPosition + len(samples)
+	}
 
-				// calculate the start and end of the overlap
-				overlapStart := startPosition
-				if overlapStart < position {
-					overlapStart = position
-				}
-				overlapEnd := segmentEnd
-				if overlapEnd > currentChunkEnd {
-					overlapEnd = currentChunkEnd
-				}
+	return track, nil
+}
 
-				// copy overlapping data to the chunk buffer
-				if overlapStart < overlapEnd {
-					srcOffset := overlapStart - startPosition
-					destOffset := overlapStart - position
-					copyLength := overlapEnd - overlapStart
-					sampleCount := len(samples)
-					chunkCount := len(chunkBuffer)
-
-					if srcOffset >= 0 && srcOffset < sampleCount &&
-						destOffset >= 0 && destOffset < chunkCount &&
-						srcOffset+copyLength <= sampleCount &&
-						destOffset+copyLength <= chunkCount {
-						copy(chunkBuffer[destOffset:destOffset+copyLength], samples[srcOffset:srcOffset+copyLength])
-					}
-				}
+func generateAudioFilesWithDemoLength(segmentsPerPlayer map[string][]common.VoiceSegment, players map[string]common.Player, codec common.VoiceCodec, durationSeconds float64, options common.ExtractOptions) ([]string, error) {
+	return common.WritePlayerFiles(segmentsPerPlayer, players, codec, true, durationSeconds, options)
+}
 
-				previousEndPosition = segmentEnd
-				if segmentEnd > currentChunkEnd {
-					break
-				}
-				segmentIndex++
-			}
+func generateAudioFilesWithCompactLength(segmentsPerPlayer map[string][]common.VoiceSegment, players map[string]common.Player, codec common.VoiceCodec, options common.ExtractOptions) ([]string, error) {
+	return common.WritePlayerFiles(segmentsPerPlayer, players, codec, false, 0, options)
+}
 
-			_, err = writer.Write(chunkBuffer)
-			if err != nil {
-				common.HandleError(common.Error{
-					Message:  "Couldn't write WAV file",
-					Err:      err,
-					ExitCode: common.WavFileCreationError,
-				})
-				return
-			}
-		}
+func writeCompactVoiceSegments(playerSegments []common.VoiceSegment, codec common.VoiceCodec, sink common.AudioSink, options common.ExtractOptions) error {
+	decode, err := codec.NewDecoder()
+	if err != nil {
+		return err
 	}
-}
 
-func generateAudioFilesWithCompactLength(segmentsPerPlayer map[string][]common.VoiceSegment, demoName string, options common.ExtractOptions) {
-	for playerID, playerSegments := range segmentsPerPlayer {
-		if len(playerSegments) == 0 {
+	position := 0
+	for _, segment := range playerSegments {
+		samples, err := decode(segment)
+		if err != nil {
+			options.Logf("%s\n", err)
 			continue
 		}
 
-		wavFilePath := buildPlayerWavFilePath(playerID, demoName, options.OutputPath)
-		outFile, err := common.CreateWavFile(wavFilePath)
+		intSamples := codec.ToInts(samples)
+		err = sink.Write(common.AudioFrame{
+			Position:  position,
+			Timestamp: segment.Timestamp,
+			Data:      intSamples,
+		})
 		if err != nil {
-			continue
+			return err
 		}
-		defer outFile.Close()
-
-		enc := goWav.NewEncoder(outFile, SampleRate, 16, 1, 1)
-		defer enc.Close()
-
-		for _, segment := range playerSegments {
-			samples, ok := decodeVoiceData(segment.Data)
-			if !ok {
-				continue
-			}
+		options.Placements.Record(segment, sink, position, len(intSamples), SampleRate)
+		position += len(intSamples)
+	}
 
-			if len(samples) > 0 {
-				// convert to ints for WAV encoding
-				numSamples := len(samples) / 2
-				intSamples := make([]int, numSamples)
-				for i := 0; i < numSamples; i++ {
-					sample := int16(uint16(samples[i*2]) | uint16(samples[i*2+1])<<8)
-					intSamples[i] = int(sample)
-				}
+	return nil
+}
 
-				buf := &audio.IntBuffer{
-					Data: intSamples,
-					Format: &audio.Format{
-						SampleRate:  SampleRate,
-						NumChannels: 1,
-					},
-				}
+func Extract(ctx context.Context, reader io.Reader, options common.ExtractOptions) (*common.Result, error) {
+	err := common.CheckLibraryFiles()
+	if err != nil {
+		return nil, err
+	}
 
-				if err := enc.Write(buf); err != nil {
-					common.HandleError(common.Error{
-						Message:  "Couldn't write WAV file",
-						Err:      err,
-						ExitCode: common.WavFileCreationError,
-					})
-				}
-			}
-		}
+	if options.HasSidecarFiles() {
+		options.Placements = common.NewPlacementRecorder()
 	}
-}
 
-func Extract(options common.ExtractOptions) {
-	common.AssertLibraryFilesExist()
+	// decoder.c loads the CELT lib and its mode globally, CSGO demos are processed one at a time
+	extractMutex.Lock()
+	defer extractMutex.Unlock()
 
-	cLibrariesPath := C.CString(common.LibrariesPath)
+	cLibrariesPath := C.CString(common.GetLibrariesPath())
 	initAudioLibResult := C.Init(cLibrariesPath)
 	C.free(unsafe.Pointer(cLibrariesPath))
 
 	if initAudioLibResult != 0 {
-		common.HandleError(common.Error{
-			Message:  "Failed to initialize CSGO audio decoder",
-			ExitCode: common.LoadCsgoLibError,
-		})
-		return
+		return nil, common.NewError("Failed to initialize CSGO audio decoder", nil, common.LoadCsgoLibError)
 	}
 
-	segmentsPerPlayer, durationSeconds, err := getSegments(options.File, options.SteamIDs)
-	common.AssertCodecIsSupported()
+	decoders := newDecoderPool(options)
+	defer func() {
+		decoders.release()
+		C.Release()
+	}()
 
+	codec := newVoiceCodec(decoders)
+	parsing, err := getSegments(ctx, reader, codec, options)
 	demoPath := options.DemoPath
 	isCorruptedDemo := errors.Is(err, dem.ErrUnexpectedEndOfDemo)
-	isCanceled := errors.Is(err, dem.ErrCancelled)
-	if err != nil && !isCorruptedDemo && !isCanceled {
-		common.HandleError(common.Error{
-			Message:  fmt.Sprintf("Failed to parse demo: %s\n", demoPath),
-			Err:      err,
-			ExitCode: common.ParsingError,
-		})
-		return
+	// the parsing is canceled once the end of the time window is reached
+	isCanceled := errors.Is(err, dem.ErrCancelled) && (!parsing.hasWindowEnded || ctx.Err() != nil)
+	var extractError *common.Error
+	isFailed := errors.As(err, &extractError) || (err != nil && !isCorruptedDemo && !errors.Is(err, dem.ErrCancelled))
+	if parsing.voiceStream != nil && (parsing.streamErr != nil || parsing.unsupportedCodec != nil || isFailed || isCanceled) {
+		// close the streamed outputs without completing them
+		_, streamErr := parsing.voiceStream.Close(0, cmp.Or(parsing.streamErr, err, dem.ErrCancelled))
+		if !isFailed && parsing.unsupportedCodec == nil && ctx.Err() == nil {
+			return nil, streamErr
+		}
+	}
+
+	if parsing.unsupportedCodec != nil {
+		return nil, common.NewUnsupportedCodecError(parsing.unsupportedCodec)
+	}
+	if extractError != nil {
+		return nil, err
+	}
+	if isFailed {
+		return nil, common.NewError(fmt.Sprintf("Failed to parse demo: %s\n", demoPath), err, common.ParsingError)
 	}
 
 	if isCanceled {
-		return
+		return nil, ctx.Err()
 	}
 
+	window := parsing.window
+	segmentsPerPlayer, players := window.SliceSegments(parsing.segmentsPerPlayer, parsing.players)
+	segmentsPerPlayer, players = options.FilterSegments(segmentsPerPlayer, players)
+	timeline := common.BuildTimeline(parsing.periods, segmentsPerPlayer, window.GetDuration(parsing.durationSeconds), window, parsing.clock, options)
+	segmentsPerPlayer, players = timeline.MapSegments(segmentsPerPlayer, players)
 	if len(segmentsPerPlayer) == 0 {
-		common.HandleError(common.Error{
-			Message:  fmt.Sprintf("No voice data found in demo %s\n", demoPath),
-			ExitCode: common.NoVoiceDataFound,
-		})
-		return
+		return nil, common.NewError(fmt.Sprintf("No voice data found in demo %s\n", demoPath), nil, common.NoVoiceDataFound)
+	}
+
+	options.Logf("Parsing done, generating audio files...\n")
+	durationSeconds := timeline.GetDuration(window.GetDuration(parsing.durationSeconds))
+	result := &common.Result{
+		Game:            common.GameCSGO,
+		DurationSeconds: durationSeconds,
+		Players:         common.SortPlayers(players, segmentsPerPlayer),
+		Rounds:          timeline.MapRounds(window.SliceRounds(parsing.rounds)),
+		Events:          timeline.MapEvents(window.SliceEvents(parsing.events)),
+		Window:          window,
+		Timeline:        timeline,
 	}
 
-	fmt.Println("Parsing done, generating audio files...")
-	demoName := strings.TrimSuffix(filepath.Base(demoPath), filepath.Ext(demoPath))
-	if options.Mode == common.ModeSingleFull {
-		generateAudioFileWithMergedVoices(segmentsPerPlayer, durationSeconds, demoName, options.OutputPath)
+	playerFilesSegments, playerFilesPlayers := options.GetPlayerFilesSegments(segmentsPerPlayer, players)
+	var files []string
+	if parsing.voiceStream != nil {
+		files, err = parsing.voiceStream.Close(durationSeconds, nil)
+	} else if options.Mode == common.ModeSingleFull {
+		files, err = generateAudioFileWithMergedVoices(segmentsPerPlayer, codec, durationSeconds, options)
+	} else if options.Mode == common.ModeMultitrack {
+		files, err = generateMultitrackAudioFile(segmentsPerPlayer, players, codec, durationSeconds, options)
+	} else if options.Mode == common.ModeSplitRounds {
+		files, err = generateRoundAudioFiles(segmentsPerPlayer, players, codec, result.Rounds, durationSeconds, options)
+	} else if options.Mode == common.ModeSplitTeam {
+		files, err = common.GenerateTeamFiles(segmentsPerPlayer, options, func(teamSegments map[string][]common.VoiceSegment, teamOptions common.ExtractOptions) ([]string, error) {
+			return generateAudioFileWithMergedVoices(teamSegments, codec, durationSeconds, teamOptions)
+		})
+	} else if options.Mode == common.ModeClips {
+		files, err = generateClipAudioFiles(segmentsPerPlayer, players, codec, options)
 	} else if options.Mode == common.ModeSplitFull {
-		generateAudioFilesWithDemoLength(segmentsPerPlayer, durationSeconds, demoName, options.OutputPath)
+		files, err = generateAudioFilesWithDemoLength(playerFilesSegments, playerFilesPlayers, codec, durationSeconds, options)
 	} else {
-		generateAudioFilesWithCompactLength(segmentsPerPlayer, demoName, options)
+		files, err = generateAudioFilesWithCompactLength(playerFilesSegments, playerFilesPlayers, codec, options)
+	}
+	result.Files = files
+	if err != nil {
+		return result, err
 	}
+
+	sidecarFiles, err := common.WriteSidecarFiles(result, segmentsPerPlayer, parsing.clock.DemoTickRate(), options)
+	result.Files = append(result.Files, sidecarFiles...)
+
+	return result, err
 }
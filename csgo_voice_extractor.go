@@ -1,22 +1,48 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/akiver/csgo-voice-extractor/common"
-	"github.com/akiver/csgo-voice-extractor/cs2"
-	"github.com/akiver/csgo-voice-extractor/csgo"
+	"github.com/akiver/csgo-voice-extractor/extractor"
 )
 
 var outputPath string
 var demoPaths []string
 var mode string
+var format string
 var steamIDs []string
+var roundPlayers bool
+var clipGap float64
+var manifest bool
+var subtitles bool
+var labels bool
+var markers string
+var timeline bool
+var eventWindow float64
+var aliveFilter string
+var splitAliveDead bool
+var teamKey string
+var stereo bool
+var pans map[uint64]float64
+var povSteamID uint64
+var start common.TimeBound
+var end common.TimeBound
+var timebase string
+var skipWarmup bool
+var collapsePauses bool
+var pauseGap float64
+var playback string
+var plc string
+var jobs int
 
 func computeOutputPathFlag() {
 	if outputPath == "" {
@@ -62,44 +88,159 @@ func computeSteamIDsFlag(steamIDsFlag string) {
 	}
 }
 
+func computePansFlag(pansFlag string) {
+	var err error
+	pans, err = common.ParsePans(pansFlag)
+	if err != nil {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid pan: %s", pansFlag), err)
+	}
+}
+
+func computePOVFlag(povFlag string) {
+	if povFlag == "" {
+		return
+	}
+
+	var err error
+	povSteamID, err = strconv.ParseUint(strings.TrimSpace(povFlag), 10, 64)
+	if err != nil {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid POV Steam ID: %s", povFlag), err)
+	}
+}
+
+func computeTimeBoundFlags(startFlag string, endFlag string) {
+	var err error
+	start, err = common.ParseTimeBound(startFlag)
+	if err != nil {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid start: %s", startFlag), err)
+	}
+
+	end, err = common.ParseTimeBound(endFlag)
+	if err != nil {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid end: %s", endFlag), err)
+	}
+
+	err = common.ExtractOptions{Start: start, End: end}.ValidateTimeBounds()
+	if err != nil {
+		common.HandleInvalidArgument("Invalid time range", err)
+	}
+}
+
+func computeModeFlag() {
+	if !common.Mode(mode).IsValid() {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid mode: %s", mode), nil)
+	}
+
+	if !common.MarkerFormat(markers).IsValid() {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid markers format: %s", markers), nil)
+	}
+
+	if eventWindow < 0 {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid event window: %f", eventWindow), nil)
+	}
+
+	if !common.PlaybackFormat(playback).IsValid() {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid playback format: %s", playback), nil)
+	}
+
+	if !common.PacketLossConcealment(plc).IsValid() {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid packet loss concealment: %s", plc), nil)
+	}
+
+	if !common.AliveFilter(aliveFilter).IsValid() {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid alive filter: %s", aliveFilter), nil)
+	}
+
+	if !common.TeamKey(teamKey).IsValid() {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid team key: %s", teamKey), nil)
+	}
+
+	if !common.Timebase(timebase).IsValid() {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid timebase: %s", timebase), nil)
+	}
+
+	if jobs < 1 {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid jobs count: %d", jobs), nil)
+	}
+
+	if pauseGap < 0 {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid pause gap: %f", pauseGap), nil)
+	}
+
+	if clipGap <= 0 {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid clip gap: %f", clipGap), nil)
+	}
+}
+
+func computeFormatFlag() {
+	if !common.Format(format).IsValid() {
+		common.HandleInvalidArgument(fmt.Sprintf("Invalid format: %s", format), nil)
+	}
+
+	if !common.Format(format).SupportsMode(common.Mode(mode)) {
+		common.HandleInvalidArgument(fmt.Sprintf("The %s format is not available with the %s mode", format, mode), nil)
+	}
+}
+
 func parseArgs() {
 	var steamIDsFlag string
+	var pansFlag string
+	var povFlag string
+	var startFlag string
+	var endFlag string
 	flag.StringVar(&outputPath, "output", "", "Output folder where WAV files will be written. Can be relative or absolute, default to the current directory.")
 	flag.BoolVar(&common.ShouldExitOnFirstError, "exit-on-first-error", false, "Exit the program on at the first error encountered, default to false.")
-	flag.StringVar(&mode, "mode", string(common.ModeSplitCompact), "Output mode. Can be 'split-compact', 'split-full' or 'single-full'. Default to 'split-compact'.")
+	flag.StringVar(&mode, "mode", string(common.ModeSplitCompact), "Output mode. Can be 'split-compact', 'split-full', 'single-full', 'multitrack', 'split-rounds', 'clips' or 'split-team'. Default to 'split-compact'.")
+	flag.StringVar(&format, "format", string(common.FormatWav), "Audio file format. Can be 'wav', 'flac' or 'opus' (CS2 only). Default to 'wav'.")
+	flag.BoolVar(&roundPlayers, "round-players", false, "With the split-rounds mode, also write 1 file per player and round, default to false.")
+	flag.Float64Var(&clipGap, "clip-gap", common.DefaultClipGapSeconds, "With the clips mode, maximum gap in seconds between 2 voice segments of the same utterance. Default to 0.5.")
+	flag.BoolVar(&manifest, "manifest", false, "Write a <demo>.voice.json file describing every utterance, default to false.")
+	flag.BoolVar(&subtitles, "subtitles", false, "With the single-full mode, write <demo>.srt and <demo>.vtt subtitles showing who is talking, default to false.")
+	flag.BoolVar(&labels, "labels", false, "With the split-full, single-full and multitrack modes, write an Audacity label track <demo>.labels.txt, default to false.")
+	flag.StringVar(&markers, "markers", "", "With the split-full, single-full and multitrack modes, write markers in <demo>.markers.csv. Can be 'reaper' or 'audition'.")
+	flag.BoolVar(&timeline, "events", false, "Write <demo>.events.json containing kills, bomb and round events with the events nearby each utterance, default to false.")
+	flag.Float64Var(&eventWindow, "event-window", common.DefaultEventWindowSeconds, "With -events, duration in seconds before and after an utterance in which events are nearby. Default to 5.")
+	flag.StringVar(&aliveFilter, "alive-filter", "", "Keep only the voice of players while they are 'alive' or 'dead'. All voices are kept by default.")
+	flag.BoolVar(&splitAliveDead, "split-alive-dead", false, "With the split-compact and split-full modes, write the voice of players while they are alive and dead in separate files, default to false.")
+	flag.StringVar(&teamKey, "team-key", string(common.TeamKeySide), "With the split-team mode, group voices by 'side' (CT/T when the player spoke) or by team 'name'. Default to 'side'.")
+	flag.BoolVar(&stereo, "stereo", false, "Mix merged files in stereo with CT on the left and T on the right, default to false.")
+	flag.StringVar(&pansFlag, "pan", "", "With -stereo, comma-separated list of steamID=pan to set the position of players from -1 (left) to 1 (right).")
+	flag.StringVar(&povFlag, "pov", "", "Steam ID 64 of the player from whose point of view merged files are mixed in stereo, only their teammates' voices are kept.")
+	flag.StringVar(&startFlag, "start", "", "Extract voices from this point of the demo, in seconds (90 or 90s), demo tick (tick:12800) or round start (round:5).")
+	flag.StringVar(&endFlag, "end", "", "Extract voices until this point of the demo, in seconds (90 or 90s), demo tick (tick:12800) or round end (round:5).")
+	flag.StringVar(&timebase, "timebase", string(common.TimebaseTime), "Clock used to place voices. Can be 'time' (demo time) or 'tick' (in-game tick and tick interval). Default to 'time'.")
+	flag.BoolVar(&skipWarmup, "skip-warmup", false, "Remove the warmup from the outputs, a <demo>.timeline.json file maps the new timeline to the demo. Default to false.")
+	flag.BoolVar(&collapsePauses, "collapse-pauses", false, "Shorten silences during pauses and timeouts to -pause-gap seconds, a <demo>.timeline.json file maps the new timeline to the demo. Default to false.")
+	flag.Float64Var(&pauseGap, "pause-gap", common.DefaultPauseGapSeconds, "With -collapse-pauses, duration in seconds of the silences kept during pauses, 0 removes them entirely. Default to 1.")
+	flag.StringVar(&playback, "playback", "", "Write a script to jump to every utterance in the game. Can be 'cfg' (<demo>.voice.cfg) or 'vdm' (<demo>.vdm, CSGO only).")
+	flag.StringVar(&plc, "plc", string(common.ConcealmentOff), "Conceal lost voice packets. Can be 'off', 'plc' (packet loss concealment) or 'fec' (forward error correction, PLC when not possible), CS2 Opus only. Default to 'off'.")
+	flag.IntVar(&jobs, "jobs", 1, "Number of demos processed at the same time, CSGO demos are always processed one at a time. Default to 1.")
 	flag.StringVar(&steamIDsFlag, "steam-ids", "", "Comma-separated list of Steam IDs 64 to extract voice data for.")
 	flag.Parse()
 
 	computeSteamIDsFlag(steamIDsFlag)
+	computePansFlag(pansFlag)
+	computePOVFlag(povFlag)
+	computeTimeBoundFlags(startFlag, endFlag)
+	computeModeFlag()
+	computeFormatFlag()
 	computeDemoPathsArgs()
 	computeOutputPathFlag()
 }
 
-func getDemoTimestamp(file *os.File, demoPath string) (string, error) {
-	buffer := make([]byte, 8)
-	n, err := io.ReadFull(file, buffer)
-	if err != nil {
-		return "", err
-	}
-
-	timestamp := string(buffer[:n])
-	timestamp = strings.TrimRight(timestamp, "\x00")
-
-	return timestamp, nil
-}
-
-func processDemoFile(demoPath string) {
-	fmt.Printf("Processing demo %s\n", demoPath)
+// processDemoFile writes the progress messages in log and calls handleError for each error.
+func processDemoFile(demoPath string, log io.Writer, handleError func(error)) {
+	fmt.Fprintf(log, "Processing demo %s\n", demoPath)
 
 	file, err := os.Open(demoPath)
 	if err != nil {
 		if _, isOpenFileError := err.(*os.PathError); isOpenFileError {
-			common.HandleError(common.NewError(
+			handleError(common.NewError(
 				fmt.Sprintf("Demo not found: %s", demoPath),
 				err,
 				common.DemoNotFound))
 		} else {
-			common.HandleError(common.NewError(
+			handleError(common.NewError(
 				fmt.Sprintf("Failed to open demo: %s", demoPath),
 				err,
 				common.OpenDemoError))
@@ -108,52 +249,100 @@ func processDemoFile(demoPath string) {
 	}
 	defer file.Close()
 
-	timestamp, err := getDemoTimestamp(file, demoPath)
-	if err != nil {
-		common.HandleError(common.NewError(
-			fmt.Sprintf("Failed to read demo timestamp: %s", demoPath),
-			err,
-			common.OpenDemoError))
-		return
+	options := extractor.Options{
+		DemoPath:             demoPath,
+		DemoName:             strings.TrimSuffix(filepath.Base(demoPath), filepath.Ext(demoPath)),
+		OutputPath:           outputPath,
+		Mode:                 common.Mode(mode),
+		Format:               common.Format(format),
+		SteamIDs:             steamIDs,
+		Log:                  log,
+		SplitRoundsPerPlayer: roundPlayers,
+		ClipGapSeconds:       clipGap,
+		Manifest:             manifest,
+		Subtitles:            subtitles,
+		Labels:               labels,
+		Markers:              common.MarkerFormat(markers),
+		Events:               timeline,
+		EventWindowSeconds:   eventWindow,
+		AliveFilter:          common.AliveFilter(aliveFilter),
+		SplitAliveDead:       splitAliveDead,
+		TeamKey:              common.TeamKey(teamKey),
+		Stereo:               stereo,
+		Pans:                 pans,
+		POVSteamID:           povSteamID,
+		Start:                start,
+		End:                  end,
+		Timebase:             common.Timebase(timebase),
+		SkipWarmup:           skipWarmup,
+		CollapsePauses:       collapsePauses,
+		PauseGapSeconds:      pauseGap,
+		Playback:             common.PlaybackFormat(playback),
+		Concealment:          common.PacketLossConcealment(plc),
 	}
 
-	_, err = file.Seek(0, 0)
+	_, err = extractor.Extract(context.Background(), file, options)
 	if err != nil {
-		common.HandleError(common.NewError(
-			fmt.Sprintf("Failed to reset demo file pointer: %s", demoPath),
-			err,
-			common.OpenDemoError))
-		return
+		handleError(err)
 	}
 
-	options := common.ExtractOptions{
-		DemoPath:   demoPath,
-		DemoName:   strings.TrimSuffix(filepath.Base(demoPath), filepath.Ext(demoPath)),
-		File:       file,
-		OutputPath: outputPath,
-		Mode:       common.Mode(mode),
-		SteamIDs:   steamIDs,
+	fmt.Fprintf(log, "End processing demo %s\n", demoPath)
+}
+
+type demoOutput struct {
+	log    bytes.Buffer
+	errors []error
+}
+
+// processDemoFilesConcurrently processes the demos with a pool of jobs workers. The messages and errors of each demo
+// are buffered and printed once the demo is processed, in the order of the demo paths.
+func processDemoFilesConcurrently() {
+	outputs := make([]chan *demoOutput, len(demoPaths))
+	for index := range outputs {
+		outputs[index] = make(chan *demoOutput, 1)
 	}
 
-	switch timestamp {
-	case "HL2DEMO":
-		csgo.Extract(options)
-	case "PBDEMS2":
-		cs2.Extract(options)
-	default:
-		common.HandleError(common.NewError(
-			fmt.Sprintf("Unsupported demo format: %s", timestamp),
-			nil,
-			common.UnsupportedDemoFormat))
+	indexes := make(chan int)
+	for range min(jobs, len(demoPaths)) {
+		go func() {
+			for index := range indexes {
+				output := &demoOutput{}
+				processDemoFile(demoPaths[index], &output.log, func(err error) {
+					output.errors = append(output.errors, err)
+				})
+				outputs[index] <- output
+			}
+		}()
 	}
 
-	fmt.Printf("End processing demo %s\n", demoPath)
+	go func() {
+		for index := range demoPaths {
+			indexes <- index
+		}
+		close(indexes)
+	}()
+
+	for _, outputChannel := range outputs {
+		output := <-outputChannel
+		os.Stdout.Write(output.log.Bytes())
+		for _, err := range output.errors {
+			common.HandleError(err)
+		}
+	}
 }
 
 func main() {
 	parseArgs()
+	common.AssertLibraryFilesExist()
+
+	if jobs > 1 {
+		processDemoFilesConcurrently()
+		return
+	}
 
 	for _, demoPath := range demoPaths {
-		processDemoFile(demoPath)
+		processDemoFile(demoPath, os.Stdout, func(err error) {
+			common.HandleError(err)
+		})
 	}
 }
@@ -0,0 +1,135 @@
+// Package extractor exports players' voices from CSGO and CS2 demos without printing anything or exiting the process.
+package extractor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/akiver/csgo-voice-extractor/common"
+	"github.com/akiver/csgo-voice-extractor/cs2"
+	"github.com/akiver/csgo-voice-extractor/csgo"
+)
+
+type Options = common.ExtractOptions
+type Result = common.Result
+
+// DetectGame reads the demo header to find out if the demo comes from CSGO (HL2DEMO) or CS2 (PBDEMS2).
+// The reader is not rewound.
+func DetectGame(reader io.Reader) (common.Game, error) {
+	buffer := make([]byte, 8)
+	n, err := io.ReadFull(reader, buffer)
+	if err != nil {
+		return "", common.NewError("Failed to read demo header", err, common.OpenDemoError)
+	}
+
+	timestamp := string(buffer[:n])
+	timestamp = strings.TrimRight(timestamp, "\x00")
+
+	switch timestamp {
+	case "HL2DEMO":
+		return common.GameCSGO, nil
+	case "PBDEMS2":
+		return common.GameCS2, nil
+	default:
+		return "", common.NewError(fmt.Sprintf("Unsupported demo format: %s", timestamp), nil, common.UnsupportedDemoFormat)
+	}
+}
+
+// Extract detects the demo's game and writes the players' voices in options.OutputPath according to options.Mode.
+// Errors are of type *common.Error unless the context is canceled, in which case the context error is returned.
+func Extract(ctx context.Context, demo io.ReadSeeker, options Options) (*Result, error) {
+	if options.Mode == "" {
+		options.Mode = common.ModeSplitCompact
+	}
+
+	if !options.Mode.IsValid() {
+		return nil, common.NewInvalidArgumentError(fmt.Sprintf("Invalid mode: %s", options.Mode), nil)
+	}
+
+	if options.Format == "" {
+		options.Format = common.FormatWav
+	}
+
+	if !options.Format.IsValid() {
+		return nil, common.NewInvalidArgumentError(fmt.Sprintf("Invalid format: %s", options.Format), nil)
+	}
+
+	if !options.Format.SupportsMode(options.Mode) {
+		return nil, common.NewInvalidArgumentError(fmt.Sprintf("The %s format is not available with the %s mode because voices can't be mixed without re-encoding them", options.Format, options.Mode), nil)
+	}
+
+	if !options.Markers.IsValid() {
+		return nil, common.NewInvalidArgumentError(fmt.Sprintf("Invalid markers format: %s", options.Markers), nil)
+	}
+
+	if !options.Playback.IsValid() {
+		return nil, common.NewInvalidArgumentError(fmt.Sprintf("Invalid playback format: %s", options.Playback), nil)
+	}
+
+	if options.Concealment == "" {
+		options.Concealment = common.ConcealmentOff
+	}
+
+	if !options.Concealment.IsValid() {
+		return nil, common.NewInvalidArgumentError(fmt.Sprintf("Invalid packet loss concealment: %s", options.Concealment), nil)
+	}
+
+	if !options.AliveFilter.IsValid() {
+		return nil, common.NewInvalidArgumentError(fmt.Sprintf("Invalid alive filter: %s", options.AliveFilter), nil)
+	}
+
+	if !options.TeamKey.IsValid() {
+		return nil, common.NewInvalidArgumentError(fmt.Sprintf("Invalid team key: %s", options.TeamKey), nil)
+	}
+
+	if options.Timebase == "" {
+		options.Timebase = common.TimebaseTime
+	}
+
+	if !options.Timebase.IsValid() {
+		return nil, common.NewInvalidArgumentError(fmt.Sprintf("Invalid timebase: %s", options.Timebase), nil)
+	}
+
+	if options.PauseGapSeconds < 0 {
+		return nil, common.NewInvalidArgumentError(fmt.Sprintf("Invalid pause gap: %f", options.PauseGapSeconds), nil)
+	}
+
+	err := options.ValidateTimeBounds()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.DemoName == "" {
+		options.DemoName = strings.TrimSuffix(filepath.Base(options.DemoPath), filepath.Ext(options.DemoPath))
+		if options.DemoName == "" || options.DemoName == "." {
+			options.DemoName = "demo"
+		}
+	}
+
+	game, err := DetectGame(demo)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = demo.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, common.NewError("Failed to reset demo file pointer", err, common.OpenDemoError)
+	}
+
+	if game == common.GameCSGO {
+		if options.Format == common.FormatOpus {
+			return nil, common.NewError("The opus format is available only for CS2 demos", nil, common.UnsupportedAudioCodec)
+		}
+
+		return csgo.Extract(ctx, demo, options)
+	}
+
+	if options.Playback == common.PlaybackFormatVdm {
+		return nil, common.NewInvalidArgumentError("The vdm playback format is available only for CSGO demos", nil)
+	}
+
+	return cs2.Extract(ctx, demo, options)
+}
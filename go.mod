@@ -9,8 +9,8 @@ require (
 	github.com/go-audio/wav v1.1.0
 	github.com/markus-wa/demoinfocs-golang/v4 v4.4.0
 	github.com/markus-wa/gobitread v0.2.4
+	github.com/mewkiz/flac v1.0.14
 	github.com/pkg/errors v0.9.1
-	github.com/youpy/go-wav v0.3.2
 	google.golang.org/protobuf v1.36.11
 	gopkg.in/hraban/opus.v2 v2.0.0-20230925203106-0188a62cb302
 )
@@ -19,13 +19,14 @@ require (
 	github.com/go-audio/riff v1.0.0 // indirect
 	github.com/golang/geo v0.0.0-20250516193853-92f93c4cb289 // indirect
 	github.com/golang/snappy v1.0.0 // indirect
+	github.com/icza/bitio v1.1.0 // indirect
 	github.com/markus-wa/go-unassert v0.1.3 // indirect
 	github.com/markus-wa/godispatch v1.4.1 // indirect
 	github.com/markus-wa/ice-cipher-go v0.0.0-20230901094113-348096939ba7 // indirect
 	github.com/markus-wa/quickhull-go/v2 v2.2.0 // indirect
+	github.com/mewkiz/pkg v0.0.0-20250417130911-3f050ff8c56d // indirect
+	github.com/mewpkg/term v0.0.0-20241026122259-37a80af23985 // indirect
 	github.com/oklog/ulid/v2 v2.1.1 // indirect
-	github.com/youpy/go-riff v0.1.0 // indirect
-	github.com/zaf/g711 v1.4.0 // indirect
 )
 
 replace github.com/markus-wa/demoinfocs-golang/v4 v4.4.0 => github.com/markus-wa/demoinfocs-golang/v4 v4.5.2-0.20260421142611-b5d1f3b8fb30